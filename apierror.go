@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// APIError is a request rejected by a provider, decoded from its error
+// response.
+type APIError struct {
+	Provider   string
+	StatusCode int
+	// Code is the provider error code or type, like "invalid_api_key".
+	Code      string
+	Message   string
+	RequestID string
+	// RetryAfter is the raw Retry-After header of the response, if any.
+	RetryAfter string
+}
+
+func (e *APIError) Error() string {
+	var details []string
+	if e.StatusCode != 0 {
+		details = append(details, fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)))
+	}
+	if e.Code != "" {
+		details = append(details, e.Code)
+	}
+	if e.Message != "" {
+		details = append(details, e.Message)
+	}
+
+	msg := e.Provider + ": " + strings.Join(details, ": ")
+	if e.RequestID != "" {
+		msg += " [request id " + e.RequestID + "]"
+	}
+
+	return msg
+}
+
+// requestIDHeaders are the response headers providers use to identify a
+// request.
+var requestIDHeaders = []string{"X-Request-Id", "Request-Id", "X-Goog-Request-Id"}
+
+// newAPIError reads and closes the body of a failed response, and decodes the
+// error shapes of all known providers:
+//
+//	{"error": {"message": "...", "type": "...", "code": "..."}}   openai, anthropic, gemini
+//	{"object": "error", "message": "...", "type": "...", "code": ...}   mistral
+//	{"error": "..."}   ollama
+func newAPIError(provider string, res *http.Response) *APIError {
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+
+	apiErr := &APIError{
+		Provider:   provider,
+		StatusCode: res.StatusCode,
+		RetryAfter: res.Header.Get("Retry-After"),
+	}
+	for _, header := range requestIDHeaders {
+		if id := res.Header.Get(header); id != "" {
+			apiErr.RequestID = id
+			break
+		}
+	}
+
+	var payload struct {
+		Error     json.RawMessage `json:"error"`
+		Message   json.RawMessage `json:"message"`
+		Type      string          `json:"type"`
+		Code      json.RawMessage `json:"code"`
+		Status    string          `json:"status"`
+		RequestID string          `json:"request_id"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		apiErr.Message = strings.TrimSpace(string(body))
+		return apiErr
+	}
+
+	if apiErr.RequestID == "" {
+		apiErr.RequestID = payload.RequestID
+	}
+
+	// the error is either nested in an "error" object, a plain "error"
+	// string, or the payload itself
+	if len(payload.Error) > 0 && payload.Error[0] == '{' {
+		nested := payload
+		nested.Error = nil
+		if err := json.Unmarshal(payload.Error, &nested); err == nil {
+			payload = nested
+		}
+	} else if message := rawString(payload.Error); message != "" {
+		apiErr.Message = message
+	}
+
+	if message := rawString(payload.Message); message != "" {
+		apiErr.Message = message
+	}
+
+	for _, code := range []string{rawString(payload.Code), payload.Status, payload.Type} {
+		if code != "" && code != fmt.Sprint(res.StatusCode) {
+			apiErr.Code = code
+			break
+		}
+	}
+
+	if apiErr.Message == "" {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+
+	return apiErr
+}
+
+// rawString returns a raw json value as text: strings are unquoted, null is
+// empty and anything else is compacted.
+func rawString(raw json.RawMessage) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, raw); err != nil {
+		return string(raw)
+	}
+	return compacted.String()
+}
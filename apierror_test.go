@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAPIError(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		status   int
+		header   http.Header
+		body     string
+		expected APIError
+	}{
+		{
+			name:     "openai",
+			provider: "openai",
+			status:   401,
+			header:   http.Header{"X-Request-Id": {"req_123"}},
+			body:     `{"error":{"message":"Incorrect API key provided","type":"invalid_request_error","param":null,"code":"invalid_api_key"}}`,
+			expected: APIError{Code: "invalid_api_key", Message: "Incorrect API key provided", RequestID: "req_123"},
+		},
+		{
+			name:     "mistral unauthorized",
+			provider: "mistral",
+			status:   401,
+			body:     `{"message":"Unauthorized","request_id":"9b1c"}`,
+			expected: APIError{Message: "Unauthorized", RequestID: "9b1c"},
+		},
+		{
+			name:     "mistral validation",
+			provider: "mistral",
+			status:   422,
+			body:     `{"object":"error","message":{"detail":[{"loc":["body","model"],"msg":"field required"}]},"type":"invalid_request_error","param":null,"code":null}`,
+			expected: APIError{Code: "invalid_request_error", Message: `{"detail":[{"loc":["body","model"],"msg":"field required"}]}`},
+		},
+		{
+			name:     "anthropic",
+			provider: "anthropic",
+			status:   529,
+			header:   http.Header{"Request-Id": {"req_018"}},
+			body:     `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+			expected: APIError{Code: "overloaded_error", Message: "Overloaded", RequestID: "req_018"},
+		},
+		{
+			name:     "gemini",
+			provider: "gemini",
+			status:   400,
+			body:     `{"error":{"code":400,"message":"API key not valid.","status":"INVALID_ARGUMENT"}}`,
+			expected: APIError{Code: "INVALID_ARGUMENT", Message: "API key not valid."},
+		},
+		{
+			name:     "ollama",
+			provider: "ollama",
+			status:   404,
+			body:     `{"error":"model 'llama9' not found"}`,
+			expected: APIError{Message: "model 'llama9' not found"},
+		},
+		{
+			name:     "not json",
+			provider: "openai",
+			status:   502,
+			header:   http.Header{"Retry-After": {"3"}},
+			body:     "<html>Bad Gateway</html>\n",
+			expected: APIError{Message: "<html>Bad Gateway</html>", RetryAfter: "3"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			for k, v := range test.header {
+				recorder.Header()[k] = v
+			}
+			recorder.WriteHeader(test.status)
+			recorder.WriteString(test.body)
+
+			expected := test.expected
+			expected.Provider = test.provider
+			expected.StatusCode = test.status
+
+			assert.Equal(t, &expected, newAPIError(test.provider, recorder.Result()))
+		})
+	}
+}
+
+func TestAPIErrorMessage(t *testing.T) {
+	err := &APIError{
+		Provider:   "openai",
+		StatusCode: 401,
+		Code:       "invalid_api_key",
+		Message:    "Incorrect API key provided",
+		RequestID:  "req_123",
+	}
+	assert.EqualError(t, err, "openai: 401 Unauthorized: invalid_api_key: Incorrect API key provided [request id req_123]")
+
+	err = &APIError{Provider: "ollama", Message: "model not found"}
+	assert.EqualError(t, err, "ollama: model not found")
+}
+
+func TestFailedRequestLeavesFileUntouched(t *testing.T) {
+	conversation := "# user\nhello\n"
+
+	for _, provider := range []string{"openai", "mistral"} {
+		t.Run(provider, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"message":"Unauthorized","request_id":"abc"}`))
+			}))
+			defer server.Close()
+
+			config, err := parseConfig(`
+provider = '` + provider + `'
+
+[` + provider + `]
+base_url = '` + server.URL + `'
+model = 'some-model'
+			`)
+			assert.NoError(t, err)
+
+			filename := filepath.Join(t.TempDir(), "chat.md")
+			assert.NoError(t, os.WriteFile(filename, []byte(conversation), 0644))
+
+			err = chat(context.Background(), config, filename, nil, &strings.Builder{})
+
+			var apiErr *APIError
+			assert.True(t, errors.As(err, &apiErr), "expected an APIError, got %v", err)
+			assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+			assert.Equal(t, "abc", apiErr.RequestID)
+
+			contents, err := os.ReadFile(filename)
+			assert.NoError(t, err)
+			assert.Equal(t, conversation, string(contents))
+		})
+	}
+}
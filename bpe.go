@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The pre-tokenization patterns of the openai encodings, without the
+// `\s+(?!\S)` alternative: go regexps have no lookahead, so splitPieces does
+// its job by hand.
+var (
+	cl100kPattern = regexp.MustCompile(`^(?:` +
+		`(?i:'s|'t|'re|'ve|'m|'ll|'d)` +
+		`|[^\r\n\p{L}\p{N}]?\p{L}+` +
+		`|\p{N}{1,3}` +
+		`| ?[^\s\p{L}\p{N}]+[\r\n]*` +
+		`|\s*[\r\n]+` +
+		`|\s+)`)
+
+	o200kPattern = regexp.MustCompile(`^(?:` +
+		`[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|\p{N}{1,3}` +
+		`| ?[^\s\p{L}\p{N}]+[\r\n/]*` +
+		`|\s*[\r\n]+` +
+		`|\s+)`)
+)
+
+// bpeEncoding is a byte pair encoding in the tiktoken format, like
+// cl100k_base.
+type bpeEncoding struct {
+	name    string
+	pattern *regexp.Regexp
+	// ranks maps the tokens to their merge priority, lowest first.
+	ranks map[string]int
+}
+
+func (e *bpeEncoding) Name() string {
+	return e.name
+}
+
+func (e *bpeEncoding) CountTokens(text string) int {
+	count := 0
+	for _, piece := range splitPieces(e.pattern, text) {
+		count += e.countPiece(piece)
+	}
+	return count
+}
+
+// splitPieces splits text with a pre-tokenization pattern. A run of spaces
+// followed by a word leaves its last space to the word, like `\s+(?!\S)`
+// does in the original patterns.
+func splitPieces(pattern *regexp.Regexp, text string) []string {
+	var pieces []string
+
+	for len(text) > 0 {
+		loc := pattern.FindStringIndex(text)
+		if loc == nil || loc[1] == 0 {
+			// unreachable with the patterns above, every rune matches
+			_, size := utf8.DecodeRuneInString(text)
+			loc = []int{0, size}
+		}
+		end := loc[1]
+
+		piece := text[:end]
+		if end < len(text) && isSpaceRun(piece) && !strings.ContainsAny(piece, "\r\n") {
+			next, _ := utf8.DecodeRuneInString(text[end:])
+			if _, size := utf8.DecodeLastRuneInString(piece); !unicode.IsSpace(next) && size < len(piece) {
+				end -= size
+			}
+		}
+
+		pieces = append(pieces, text[:end])
+		text = text[end:]
+	}
+
+	return pieces
+}
+
+func isSpaceRun(s string) bool {
+	for _, r := range s {
+		if !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// countPiece returns the number of tokens of a piece, merging its bytes pair
+// by pair, lowest rank first.
+func (e *bpeEncoding) countPiece(piece string) int {
+	if _, ok := e.ranks[piece]; ok {
+		return 1
+	}
+
+	// parts holds the boundaries of the tokens, starting with single bytes
+	parts := make([]int, len(piece)+1)
+	for i := range parts {
+		parts[i] = i
+	}
+
+	for len(parts) > 2 {
+		best, bestRank := -1, math.MaxInt
+		for i := 0; i+2 < len(parts); i++ {
+			if rank, ok := e.ranks[piece[parts[i]:parts[i+2]]]; ok && rank < bestRank {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		parts = append(parts[:best+1], parts[best+2:]...)
+	}
+
+	return len(parts) - 1
+}
+
+// parseRanks reads a tiktoken file: a base64 token and its rank per line.
+func parseRanks(r io.Reader) (map[string]int, error) {
+	ranks := make(map[string]int)
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if scanner.Text() == "" {
+			continue
+		}
+
+		encoded, rank, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected a token and a rank", line)
+		}
+		token, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		n, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		ranks[string(token)] = n
+	}
+
+	return ranks, scanner.Err()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitPieces(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"hello world", []string{"hello", " world"}},
+		{"hello   world", []string{"hello", "  ", " world"}},
+		{"hello\n\nworld", []string{"hello", "\n\n", "world"}},
+		{"trailing  ", []string{"trailing", "  "}},
+		{"I'm 12345", []string{"I", "'m", " ", "123", "45"}},
+		{"x = {a}", []string{"x", " =", " {", "a", "}"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			assert.Equal(t, tt.want, splitPieces(cl100kPattern, tt.text))
+		})
+	}
+}
+
+func TestBPECountTokens(t *testing.T) {
+	var table strings.Builder
+	for rank, token := range []string{"a", "b", "c", " ", "ab", "abc", " a"} {
+		fmt.Fprintf(&table, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(token)), rank)
+	}
+	ranks, err := parseRanks(strings.NewReader(table.String()))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, ranks["abc"])
+
+	encoding := &bpeEncoding{name: "test", pattern: cl100kPattern, ranks: ranks}
+	assert.Equal(t, 1, encoding.countPiece("abc"))
+	assert.Equal(t, 2, encoding.countPiece("abab"))
+	assert.Equal(t, 2, encoding.countPiece("abca"))
+	// unknown bytes are tokens of their own
+	assert.Equal(t, 3, encoding.countPiece("xab!"))
+	assert.Equal(t, 4, encoding.CountTokens("abc abab"))
+
+	_, err = parseRanks(strings.NewReader("YQ==\n"))
+	assert.EqualError(t, err, "line 1: expected a token and a rank")
+}
+
+func TestEmbeddedEncodings(t *testing.T) {
+	for model, name := range map[string]string{"gpt-4": "cl100k_base", "gpt-4o": "o200k_base"} {
+		tk := tokenizerFor(model)
+		assert.Equal(t, name, tk.Name())
+		assert.Equal(t, 2, tk.CountTokens("hello world"), model)
+	}
+}
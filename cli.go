@@ -0,0 +1,664 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime/debug"
+	"strings"
+	"text/tabwriter"
+)
+
+// Exit codes of sira.
+const (
+	exitOK    = 0
+	exitError = 1
+	// exitUsage is returned for mistakes in the command line.
+	exitUsage = 2
+	// exitInterrupted is returned when Ctrl-C cancels a request, like
+	// shells do for processes killed by SIGINT.
+	exitInterrupted = 130
+)
+
+// version is set at build time with -ldflags "-X main.version=v1.0.0". When
+// empty, the version of the module installed with go install is used.
+var version = ""
+
+func versionString() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// verboseLog prints details about what sira does, enabled by --verbose.
+var verboseLog = log.New(io.Discard, "", 0)
+
+// cli is a single run of sira: its streams and its flags.
+type cli struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	configPath string
+	provider   string
+	model      string
+	profile    string
+	verbose    bool
+	params     paramFlags
+}
+
+// command is a subcommand of sira.
+type command struct {
+	name string
+	// args describes the positional arguments, like "<dir>".
+	args    string
+	summary string
+	// nargs is the number of positional arguments, -1 for any.
+	nargs int
+	// params adds the --param flag.
+	params bool
+	run    func(c *cli, ctx context.Context, args []string) error
+}
+
+var commands = []*command{
+	{
+		name:    "chat",
+		args:    "<file>",
+		summary: "send a conversation and append the answer to it, the default command",
+		nargs:   1,
+		params:  true,
+		run:     (*cli).chat,
+	},
+	{
+		name:    "new",
+		args:    "<dir>",
+		summary: "create a template in dir",
+		nargs:   1,
+		run:     (*cli).newTemplate,
+	},
+	{
+		name:    "run",
+		args:    "<dir>",
+		summary: "render the template in dir into a new conversation and send it",
+		nargs:   1,
+		params:  true,
+		run:     (*cli).runTemplate,
+	},
+	{
+		name:    "render",
+		args:    "<file or dir>",
+		summary: "print the messages of a conversation or template as they would be sent",
+		nargs:   1,
+		params:  true,
+		run:     (*cli).render,
+	},
+	{
+		name:    "tokens",
+		args:    "<file>",
+		summary: "count the tokens of a conversation and estimate what sending it costs",
+		nargs:   1,
+		params:  true,
+		run:     (*cli).tokens,
+	},
+	{
+		name:    "usage",
+		args:    "[grouping]",
+		summary: "report the tokens and cost of past requests, by day, model or file",
+		nargs:   -1,
+		run:     (*cli).usage,
+	},
+	{
+		name:    "models",
+		summary: "list the models of the provider",
+		nargs:   0,
+		run:     (*cli).models,
+	},
+	{
+		name:    "config",
+		args:    "<subcommand>",
+		summary: "print the paths of the config files (path), the merged config and where each setting comes from (show), or check it (validate)",
+		nargs:   1,
+		run:     (*cli).config,
+	},
+	{
+		name:    "version",
+		summary: "print the version of sira",
+		nargs:   0,
+		run:     (*cli).version,
+	},
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// usageError is a mistake in the command line.
+type usageError struct {
+	// command is the name of the command, empty for sira itself.
+	command string
+	msg     string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+// runCLI runs sira with args, without the program name, and returns its exit
+// code.
+func runCLI(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	c := &cli{stdin: stdin, stdout: stdout, stderr: stderr}
+	err := c.run(ctx, args)
+
+	var usageErr *usageError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, ErrInterrupted):
+		fmt.Fprintln(stderr, err)
+		return exitInterrupted
+	case errors.As(err, &usageErr):
+		fmt.Fprintf(stderr, "sira: %v\n", err)
+		if usageErr.command != "" {
+			fmt.Fprintf(stderr, "Run 'sira help %s' for usage.\n", usageErr.command)
+		} else {
+			fmt.Fprintln(stderr, "Run 'sira help' for usage.")
+		}
+		return exitUsage
+	default:
+		fmt.Fprintf(stderr, "sira: %v\n", err)
+		return exitError
+	}
+}
+
+func (c *cli) run(ctx context.Context, args []string) error {
+	global := c.flagSet("sira", nil)
+	if err := global.Parse(args); err != nil {
+		return c.flagError(nil, err)
+	}
+	args = global.Args()
+	if len(args) == 0 {
+		return &usageError{msg: "missing command or file"}
+	}
+
+	if args[0] == "help" {
+		return c.help(args[1:])
+	}
+
+	// sira <file> is sira chat <file>
+	cmd := findCommand(args[0])
+	if cmd != nil {
+		args = args[1:]
+	} else if _, err := os.Stat(args[0]); err != nil && !strings.Contains(args[0], ".") {
+		return &usageError{msg: fmt.Sprintf("unknown command %q", args[0])}
+	} else {
+		cmd = findCommand("chat")
+	}
+
+	positional, err := parseInterspersed(c.flagSet("sira "+cmd.name, cmd), args)
+	if err != nil {
+		return c.flagError(cmd, err)
+	}
+	if cmd.nargs >= 0 && len(positional) != cmd.nargs {
+		return &usageError{command: cmd.name, msg: fmt.Sprintf("%s expects %d arguments, got %d", cmd.name, cmd.nargs, len(positional))}
+	}
+
+	if c.verbose {
+		verboseLog.SetOutput(c.stderr)
+	}
+
+	return cmd.run(c, ctx, positional)
+}
+
+// flagSet returns the flags of cmd, the global ones when cmd is nil.
+func (c *cli) flagSet(name string, cmd *command) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+
+	flags.StringVar(&c.configPath, "config", c.configPath, "read the config from `path` only, instead of the discovered files")
+	flags.StringVar(&c.provider, "provider", c.provider, "use the provider or config section `name`")
+	flags.StringVar(&c.model, "model", c.model, "use the model `name`")
+	flags.StringVar(&c.profile, "profile", c.profile, "use the config profile `name`")
+	flags.BoolVar(&c.verbose, "verbose", c.verbose, "print details about the requests")
+
+	if cmd != nil && cmd.params {
+		flags.Var(&c.params, "param", "set a template param, as `key=value`, key=@file or key=@- to read stdin")
+	}
+
+	return flags
+}
+
+// parseInterspersed parses flags placed anywhere among the positional
+// arguments, which it returns. Everything after "--" is positional.
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+
+		rest := flags.Args()
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// flagError turns a flag parsing error into a usage error. -h and --help
+// print the help and succeed.
+func (c *cli) flagError(cmd *command, err error) error {
+	if errors.Is(err, flag.ErrHelp) {
+		if cmd == nil {
+			c.printUsage(c.stdout)
+		} else {
+			c.printCommandHelp(c.stdout, cmd)
+		}
+		return nil
+	}
+
+	usageErr := &usageError{msg: err.Error()}
+	if cmd != nil {
+		usageErr.command = cmd.name
+	}
+	return usageErr
+}
+
+func (c *cli) help(args []string) error {
+	if len(args) == 0 {
+		c.printUsage(c.stdout)
+		return nil
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil || len(args) > 1 {
+		return &usageError{msg: fmt.Sprintf("unknown command %q", strings.Join(args, " "))}
+	}
+
+	c.printCommandHelp(c.stdout, cmd)
+	return nil
+}
+
+func (c *cli) printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: sira [flags] <command> [args]")
+	fmt.Fprintln(w, "       sira [flags] <file>")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", cmd.name, cmd.args, cmd.summary)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Flags:")
+	flags := c.flagSet("sira", nil)
+	flags.SetOutput(w)
+	flags.PrintDefaults()
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'sira help <command>' for more about a command.")
+}
+
+func (c *cli) printCommandHelp(w io.Writer, cmd *command) {
+	usage := "sira " + cmd.name + " [flags]"
+	if cmd.args != "" {
+		usage += " " + cmd.args
+	}
+
+	fmt.Fprintf(w, "Usage: %s\n\n", usage)
+	fmt.Fprintf(w, "%s%s.\n\n", strings.ToUpper(cmd.summary[:1]), cmd.summary[1:])
+	fmt.Fprintln(w, "Flags:")
+
+	flags := c.flagSet("sira "+cmd.name, cmd)
+	flags.SetOutput(w)
+	flags.PrintDefaults()
+}
+
+// configPaths returns the config files to read, lowest precedence first:
+// the --config file, or the ones discovered.
+func (c *cli) configPaths() ([]string, error) {
+	if c.configPath != "" {
+		return []string{c.configPath}, nil
+	}
+	return discoverConfigFiles()
+}
+
+// loadConfig reads the config files and the environment, with the command
+// line flags on top.
+func (c *cli) loadConfig() (*configFile, error) {
+	paths, err := c.configPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := loadConfigFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		verboseLog.Printf("config %s", path)
+	}
+
+	config.flags = make(map[string]any)
+	if c.provider != "" {
+		config.flags["provider"] = c.provider
+	}
+	if c.model != "" {
+		config.flags["model"] = c.model
+	}
+	if c.profile != "" {
+		config.flags["profile"] = c.profile
+	}
+
+	return config, nil
+}
+
+// templateParams returns the --param flags, asking for the missing ones when
+// stdin is a terminal that isn't read by a param.
+func (c *cli) templateParams() (*templateParams, error) {
+	values, err := parseParamFlags(c.params, c.stdin)
+	if err != nil {
+		return nil, &usageError{msg: err.Error()}
+	}
+	params := &templateParams{values: values}
+
+	readsStdin := false
+	for _, arg := range c.params {
+		readsStdin = readsStdin || strings.HasSuffix(arg, "=@-")
+	}
+	if f, ok := c.stdin.(*os.File); ok && isTerminal(f) && !readsStdin {
+		params.ask = askParam(c.stdin, c.stderr)
+	}
+
+	return params, nil
+}
+
+func (c *cli) chat(ctx context.Context, args []string) error {
+	config, err := c.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	params, err := c.templateParams()
+	if err != nil {
+		return err
+	}
+
+	return chat(ctx, config, args[0], params, c.stdout)
+}
+
+func (c *cli) newTemplate(ctx context.Context, args []string) error {
+	if err := startTemplate(args[0]); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stdout, "Edit %s/template.md and %s/params.toml, then run 'sira run %s'.\n", args[0], args[0], args[0])
+	return nil
+}
+
+func (c *cli) runTemplate(ctx context.Context, args []string) error {
+	config, err := c.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	params, err := c.templateParams()
+	if err != nil {
+		return err
+	}
+
+	return runTemplate(ctx, config, args[0], params, c.stdout)
+}
+
+func (c *cli) render(ctx context.Context, args []string) error {
+	params, err := c.templateParams()
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(args[0])
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		settings, messages, err := renderTemplateDir(args[0], params)
+		if err != nil {
+			return err
+		}
+		return writeConversation(c.stdout, settings, messages, false)
+	}
+
+	contents, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	doc := parseDocument(string(contents))
+	values, err := params.resolve(doc, nil)
+	if err != nil {
+		return err
+	}
+
+	messages, err := renderDocument(doc, string(contents), args[0], values)
+	if err != nil {
+		return err
+	}
+	return writeConversation(c.stdout, nil, messages, false)
+}
+
+func (c *cli) tokens(ctx context.Context, args []string) error {
+	config, err := c.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	params, err := c.templateParams()
+	if err != nil {
+		return err
+	}
+
+	contents, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	doc := parseDocument(string(contents))
+	config, err = config.forDocument(doc, args[0])
+	if err != nil {
+		return err
+	}
+
+	values, err := params.resolve(doc, nil)
+	if err != nil {
+		return err
+	}
+
+	messages, err := renderDocument(doc, string(contents), args[0], values)
+	if err != nil {
+		return err
+	}
+
+	window, err := config.contextWindow()
+	if err != nil {
+		return err
+	}
+
+	return printTokenReport(c.stdout, doc, messages, window)
+}
+
+func (c *cli) usage(ctx context.Context, args []string) error {
+	by := "day"
+	if len(args) > 0 {
+		by = args[0]
+	}
+	if _, ok := usageGroupings[by]; !ok || len(args) > 1 {
+		return &usageError{command: "usage", msg: fmt.Sprintf("unknown grouping %q, expected day, model or file", strings.Join(args, " "))}
+	}
+
+	config, err := c.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	ledger, err := config.usageLedger()
+	if err != nil {
+		return err
+	}
+	if ledger == "" {
+		return errors.New("usage recording is disabled in [usage]")
+	}
+	verboseLog.Printf("usage ledger %s", ledger)
+
+	records, err := readUsage(ledger)
+	if err != nil {
+		return err
+	}
+
+	return printUsageReport(c.stdout, records, by)
+}
+
+func (c *cli) models(ctx context.Context, args []string) error {
+	config, err := c.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	config, err = config.withFlags()
+	if err != nil {
+		return err
+	}
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	provider, err := newProvider(config)
+	if err != nil {
+		return err
+	}
+
+	models, err := provider.ListModels(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, model := range models {
+		fmt.Fprintln(c.stdout, model)
+	}
+	return nil
+}
+
+func (c *cli) config(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "path":
+		paths, err := c.configPaths()
+		if err != nil {
+			return err
+		}
+		if len(paths) == 0 {
+			path, err := defaultConfigPath()
+			if err != nil {
+				return err
+			}
+			paths = []string{path}
+		}
+		for i := len(paths) - 1; i >= 0; i-- {
+			fmt.Fprintln(c.stdout, paths[i])
+		}
+		return nil
+
+	case "show":
+		config, err := c.loadConfig()
+		if err != nil {
+			return err
+		}
+		flags := config.flags
+		config, err = config.withFlags()
+		if err != nil {
+			return err
+		}
+
+		values, origins := config.explained()
+		if _, ok := flags["provider"]; ok {
+			origins["provider"] = "--provider"
+		}
+		if selected, err := config.selectedProvider(); err == nil && flags["model"] != nil {
+			origins[selected+".model"] = "--model"
+		}
+		return writeExplainedConfig(c.stdout, values, origins)
+
+	case "validate":
+		config, err := c.loadConfig()
+		if err != nil {
+			return err
+		}
+		return config.validate()
+	}
+
+	return &usageError{command: "config", msg: fmt.Sprintf("unknown config command %q", args[0])}
+}
+
+func (c *cli) version(ctx context.Context, args []string) error {
+	fmt.Fprintln(c.stdout, "sira", versionString())
+	return nil
+}
+
+// redacted returns the config as a map, with the selected provider and the
+// api keys masked.
+func (file *configFile) redacted() map[string]any {
+	values := make(map[string]any)
+	if file.Apikey != "" {
+		values["apikey"] = maskSecret(file.Apikey)
+	}
+	if file.ApikeyCmd != "" {
+		values["apikey_cmd"] = file.ApikeyCmd
+	}
+	if selected, err := file.selectedProvider(); err == nil {
+		values["provider"] = selected
+	}
+	if file.DefaultProfile != "" {
+		values["default_profile"] = file.DefaultProfile
+	}
+
+	for name, section := range file.sections {
+		copied := make(map[string]any, len(section))
+		for key, value := range section {
+			if secret, ok := value.(string); ok && key == "apikey" {
+				value = maskSecret(secret)
+			}
+			copied[key] = value
+		}
+		values[name] = copied
+	}
+
+	return values
+}
+
+// maskSecret keeps the start and the end of a secret, enough to tell keys
+// apart.
+func maskSecret(secret string) string {
+	if len(secret) <= 12 {
+		return strings.Repeat("*", len(secret))
+	}
+	return secret[:3] + "..." + secret[len(secret)-4:]
+}
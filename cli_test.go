@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// runSira runs the cli with args and returns its exit code, stdout and
+// stderr.
+func runSira(t *testing.T, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+
+	var stdout, stderr strings.Builder
+	code := runCLI(context.Background(), args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+// newOllamaConfig writes a config file using an ollama server answering
+// "hello", and returns its path with the requests the server receives.
+func newOllamaConfig(t *testing.T) (string, *[]ollamaChatRequest) {
+	var received []ollamaChatRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/tags" {
+			fmt.Fprintln(w, `{"models":[{"name":"llama2"},{"name":"mistral"}]}`)
+			return
+		}
+
+		var request ollamaChatRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		received = append(received, request)
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"hello"},"done":true}`)
+	}))
+	t.Cleanup(server.Close)
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	assert.NoError(t, os.WriteFile(path, []byte(`
+apikey = "sk-0123456789abcdef"
+provider = "ollama"
+
+[openai]
+model = "gpt-4"
+
+[ollama]
+base_url = '`+server.URL+`'
+model = "llama2"
+`), 0600))
+
+	return path, &received
+}
+
+func TestCLIChat(t *testing.T) {
+	config, received := newOllamaConfig(t)
+
+	filename := filepath.Join(t.TempDir(), "chat.md")
+	assert.NoError(t, os.WriteFile(filename, []byte("+++\nmodel = 'llama3'\n+++\n# user\nhi {name}\n"), 0644))
+
+	code, stdout, stderr := runSira(t, "", "--config", config, filename, "--param", "name=sira", "--model", "mistral", "--verbose")
+	assert.Equal(t, exitOK, code, stderr)
+	assert.Equal(t, "hello\n", stdout)
+	assert.Contains(t, stderr, "sending 1 messages to ollama, model mistral")
+
+	code, _, stderr = runSira(t, "", "chat", "--config", config, "--param", "name=sira", "--", filename)
+	assert.Equal(t, exitOK, code, stderr)
+
+	if assert.Len(t, *received, 2) {
+		assert.Equal(t, "mistral", (*received)[0].Model)
+		assert.Equal(t, "llama3", (*received)[1].Model)
+		assert.Equal(t, "hi sira", (*received)[1].Messages[0].Content)
+	}
+}
+
+func TestCLIRender(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "haiku")
+
+	code, stdout, _ := runSira(t, "", "new", dir)
+	assert.Equal(t, exitOK, code)
+	assert.Contains(t, stdout, "sira run "+dir)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "template.md"), []byte("# system\nWrite about {topic}.\n\n# user\n{code}\n"), 0644))
+
+	code, stdout, stderr := runSira(t, "func main() {}\n", "render", "--param", "topic=go", "--param", "code=@-", dir)
+	assert.Equal(t, exitOK, code, stderr)
+	assert.Equal(t, "+++\n[openai]\n  max_tokens = 500\n  model = \"gpt-3.5-turbo\"\n  temperature = 0.7\n+++\n# system\nWrite about go.\n\n# user\nfunc main() {}\n", stdout)
+
+	code, _, stderr = runSira(t, "", "render", dir)
+	assert.Equal(t, exitError, code)
+	assert.Contains(t, stderr, "template.md:2:13: undefined placeholder {topic}")
+}
+
+func TestCLIModelsAndConfig(t *testing.T) {
+	config, _ := newOllamaConfig(t)
+
+	code, stdout, stderr := runSira(t, "", "--config", config, "models")
+	assert.Equal(t, exitOK, code, stderr)
+	assert.Equal(t, "llama2\nmistral\n", stdout)
+
+	code, stdout, _ = runSira(t, "", "config", "path", "--config", config)
+	assert.Equal(t, exitOK, code)
+	assert.Equal(t, config+"\n", stdout)
+
+	code, stdout, _ = runSira(t, "", "config", "show", "--config", config, "--provider", "openai", "--model", "gpt-4o")
+	assert.Equal(t, exitOK, code)
+	assert.Contains(t, stdout, `apikey = "sk-...cdef"`)
+	assert.Contains(t, stdout, `provider = "openai"`)
+	assert.Contains(t, stdout, `model = "gpt-4o"`)
+}
+
+func TestCLIUsage(t *testing.T) {
+	code, stdout, _ := runSira(t, "", "help")
+	assert.Equal(t, exitOK, code)
+	assert.Contains(t, stdout, "Usage: sira [flags] <command> [args]")
+	assert.Contains(t, stdout, "  render   <file or dir>  print the messages")
+
+	code, stdout, _ = runSira(t, "", "run", "-h")
+	assert.Equal(t, exitOK, code)
+	assert.Contains(t, stdout, "Usage: sira run [flags] <dir>")
+	assert.Contains(t, stdout, "-param key=value")
+
+	code, stdout, _ = runSira(t, "", "version")
+	assert.Equal(t, exitOK, code)
+	assert.True(t, strings.HasPrefix(stdout, "sira "))
+
+	tests := []struct {
+		args   []string
+		stderr string
+	}{
+		{nil, "sira: missing command or file\nRun 'sira help' for usage.\n"},
+		{[]string{"modles"}, "sira: unknown command \"modles\"\nRun 'sira help' for usage.\n"},
+		{[]string{"run"}, "sira: run expects 1 arguments, got 0\nRun 'sira help run' for usage.\n"},
+		{[]string{"models", "--param", "a=b"}, "sira: flag provided but not defined: -param\nRun 'sira help models' for usage.\n"},
+		{[]string{"config", "edit"}, "sira: unknown config command \"edit\"\nRun 'sira help config' for usage.\n"},
+		{[]string{"help", "nope"}, "sira: unknown command \"nope\"\nRun 'sira help' for usage.\n"},
+	}
+	for _, tt := range tests {
+		code, _, stderr := runSira(t, "", tt.args...)
+		assert.Equal(t, exitUsage, code, tt.args)
+		assert.Equal(t, tt.stderr, stderr, tt.args)
+	}
+
+	code, _, stderr := runSira(t, "", "--config", filepath.Join(t.TempDir(), "missing.toml"), "models")
+	assert.Equal(t, exitError, code)
+	assert.Contains(t, stderr, "sira: could not read config: open ")
+}
+
+func TestCLITokens(t *testing.T) {
+	config, received := newOllamaConfig(t)
+
+	filename := filepath.Join(t.TempDir(), "chat.md")
+	assert.NoError(t, os.WriteFile(filename, []byte("# system\nbe brief\n\n# user\nhi {name}\n"), 0644))
+
+	code, stdout, stderr := runSira(t, "", "--config", config, "tokens", "--param", "name=sira", filename)
+	assert.Equal(t, exitOK, code, stderr)
+	assert.Equal(t, `line  role    tokens
+1     system  7
+4     user    6
+
+total:   16 tokens (estimated)
+context: 4096 tokens, 4080 left
+cost:    $0.000000 input
+`, stdout)
+	assert.Empty(t, *received)
+
+	code, stdout, stderr = runSira(t, "", "--config", config, "tokens", "--param", "name=sira", "--provider", "openai", filename)
+	assert.Equal(t, exitOK, code, stderr)
+	assert.Contains(t, stdout, "context: 8192 tokens")
+	assert.Contains(t, stdout, "cost:    $0.000480 input")
+
+	code, stdout, stderr = runSira(t, "", "--config", config, "tokens", "--param", "name=sira", "--model", "local", filename)
+	assert.Equal(t, exitOK, code, stderr)
+	assert.Contains(t, stdout, `cost:    unknown for model "local"`)
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/BurntSushi/toml"
+)
+
+// The config is merged from layers, each overriding the previous ones:
+//
+//	SIRA_* environment variables, like SIRA_PROVIDER or SIRA_OPENAI_MODEL
+//	~/.sira.toml
+//	$XDG_CONFIG_HOME/sira/config.toml, ~/.config/sira/config.toml by default
+//	.sira.toml in the working directory or the nearest parent, for projects
+//
+// --config replaces the files with a single one.
+
+// configFileName is the name of the config file in the home directory and in
+// projects.
+const configFileName = ".sira.toml"
+
+// configEnvPrefix is the prefix of the environment variables setting the
+// config. SIRA_<KEY> sets a top level key and SIRA_<SECTION>_<KEY> a key of
+// a section.
+const configEnvPrefix = "SIRA_"
+
+// topLevelKeys are the keys of the config outside of sections.
+var topLevelKeys = []string{"apikey", "apikey_cmd", "provider", "default_profile"}
+
+// apiKeyEnv are the environment variables holding the api key of each kind
+// of provider, used when its section has none.
+var apiKeyEnv = map[string]string{
+	"openai":    "OPENAI_API_KEY",
+	"mistral":   "MISTRAL_API_KEY",
+	"anthropic": "ANTHROPIC_API_KEY",
+	"gemini":    "GEMINI_API_KEY",
+}
+
+// apiKey returns the api key of a provider section, from the first of:
+// its own apikey or apikey_cmd, the environment variable of its kind of
+// provider, like MISTRAL_API_KEY, then the top level apikey or apikey_cmd
+// shared by every provider.
+func (file *configFile) apiKey(section, own, ownCmd string) (string, error) {
+	if own != "" {
+		return own, nil
+	}
+	if ownCmd != "" {
+		return runSecretCommand(ownCmd)
+	}
+
+	if key, _ := file.apiKeyFromEnv(section); key != "" {
+		return key, nil
+	}
+
+	if file.Apikey == "" && file.ApikeyCmd != "" {
+		return runSecretCommand(file.ApikeyCmd)
+	}
+	return file.Apikey, nil
+}
+
+// apiKeyFromEnv returns the api key of a section from the environment
+// variable of its kind of provider, and the name of the variable.
+func (file *configFile) apiKeyFromEnv(section string) (string, string) {
+	kind, _ := file.providerType(section)
+	if name, ok := apiKeyEnv[kind]; ok {
+		return os.Getenv(name), name
+	}
+	return "", ""
+}
+
+var (
+	secretsMu sync.Mutex
+	// secrets caches the output of the secret commands for the lifetime of
+	// the process, so a password manager is asked only once.
+	secrets = map[string]string{}
+)
+
+// runSecretCommand runs command with the shell and returns its output,
+// trimmed. It fails when the command fails or prints nothing.
+func runSecretCommand(command string) (string, error) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	if secret, ok := secrets[command]; ok {
+		return secret, nil
+	}
+
+	cmd := exec.Command("sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	}
+	var stderr bytes.Buffer
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("apikey_cmd %q failed: %w: %s", command, err, msg)
+		}
+		return "", fmt.Errorf("apikey_cmd %q failed: %w", command, err)
+	}
+
+	secret := strings.TrimSpace(string(output))
+	if secret == "" {
+		return "", fmt.Errorf("apikey_cmd %q printed no key", command)
+	}
+
+	secrets[command] = secret
+	return secret, nil
+}
+
+// defaultConfigPath returns the path of the config file in the home
+// directory.
+func defaultConfigPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, configFileName), nil
+}
+
+// discoverConfigFiles returns the config files that exist, lowest precedence
+// first.
+func discoverConfigFiles() ([]string, error) {
+	var candidates []string
+
+	home, err := os.UserHomeDir()
+	if err == nil {
+		candidates = append(candidates, filepath.Join(home, configFileName))
+	}
+
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" && home != "" {
+		configHome = filepath.Join(home, ".config")
+	}
+	if configHome != "" {
+		candidates = append(candidates, filepath.Join(configHome, "sira", "config.toml"))
+	}
+
+	if local, err := findProjectConfig(home); err != nil {
+		return nil, err
+	} else if local != "" {
+		candidates = append(candidates, local)
+	}
+
+	var found []string
+	for _, path := range candidates {
+		info, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			found = append(found, path)
+		}
+	}
+
+	return found, nil
+}
+
+// findProjectConfig returns the .sira.toml of the working directory or of
+// its nearest parent, stopping at the home directory whose config is
+// already a layer of its own.
+func findProjectConfig(home string) (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	for dir != home {
+		path := filepath.Join(dir, configFileName)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	return "", nil
+}
+
+// configLayer is a source of settings, like a file.
+type configLayer struct {
+	values map[string]any
+	// origins maps the dotted path of each setting to where it comes from.
+	origins map[string]string
+}
+
+// fileLayer reads a config file.
+func fileLayer(path string) (*configLayer, error) {
+	contents, err := readConfig(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config: %w", err)
+	}
+
+	var values map[string]any
+	if _, err := toml.Decode(contents, &values); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+
+	if hasPlaintextKey(values) {
+		if info, err := os.Stat(path); err == nil && runtime.GOOS != "windows" && info.Mode().Perm()&0o004 != 0 {
+			return nil, fmt.Errorf("%s holds an api key and is readable by everyone, run chmod 600 %s or use apikey_cmd", path, path)
+		}
+	}
+
+	layer := &configLayer{values: values, origins: make(map[string]string)}
+	walkSettings(values, "", func(setting string) {
+		layer.origins[setting] = path
+	})
+
+	return layer, nil
+}
+
+// hasPlaintextKey reports whether a config holds an apikey, at the top level
+// or in a table at any depth, like the section of a profile.
+func hasPlaintextKey(values map[string]any) bool {
+	if key, _ := values["apikey"].(string); key != "" {
+		return true
+	}
+	for _, value := range values {
+		if table, ok := value.(map[string]any); ok && hasPlaintextKey(table) {
+			return true
+		}
+	}
+	return false
+}
+
+// envLayer reads the SIRA_* variables of environ, template params aside.
+// Only the top level keys and SIRA_<section>_<key>, for the given sections,
+// are settings: other variables are ignored, and the longest section name
+// matching wins, so [my_llama] is set with SIRA_MY_LLAMA_MODEL.
+func envLayer(environ []string, sections []string) *configLayer {
+	layer := &configLayer{values: make(map[string]any), origins: make(map[string]string)}
+
+	sections = append([]string{}, sections...)
+	sort.SliceStable(sections, func(i, j int) bool {
+		return len(sections[i]) > len(sections[j])
+	})
+
+	for _, variable := range environ {
+		name, value, _ := strings.Cut(variable, "=")
+		if !strings.HasPrefix(name, configEnvPrefix) || strings.HasPrefix(name, paramEnvPrefix) {
+			continue
+		}
+
+		key := strings.ToLower(strings.TrimPrefix(name, configEnvPrefix))
+		if containsString(topLevelKeys, key) {
+			layer.values[key] = coerceParam(value)
+			layer.origins[key] = "env " + name
+			continue
+		}
+
+		section, sectionKey := "", ""
+		for _, candidate := range sections {
+			if rest, ok := strings.CutPrefix(key, candidate+"_"); ok && rest != "" {
+				section, sectionKey = candidate, rest
+				break
+			}
+		}
+		if section == "" {
+			continue
+		}
+
+		table, _ := layer.values[section].(map[string]any)
+		if table == nil {
+			table = make(map[string]any)
+			layer.values[section] = table
+		}
+		table[sectionKey] = coerceParam(value)
+		layer.origins[section+"."+sectionKey] = "env " + name
+	}
+
+	return layer
+}
+
+// walkSettings calls fn with the dotted path of every setting of values,
+// tables excluded.
+func walkSettings(values map[string]any, prefix string, fn func(path string)) {
+	for key, value := range values {
+		if table, ok := value.(map[string]any); ok {
+			walkSettings(table, prefix+key+".", fn)
+			continue
+		}
+		fn(prefix + key)
+	}
+}
+
+// loadConfigFiles merges the environment and the config files at paths,
+// lowest precedence first.
+func loadConfigFiles(paths []string) (*configFile, error) {
+	var files []*configLayer
+	for _, path := range paths {
+		layer, err := fileLayer(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, layer)
+	}
+
+	layers := append([]*configLayer{envLayer(os.Environ(), envSections(files))}, files...)
+	return mergeLayers(layers)
+}
+
+// envSections returns the sections the environment can set: the built-in
+// ones, the providers and the sections of the config files.
+func envSections(files []*configLayer) []string {
+	sections := providerNames()
+	for name := range sectionSchemas {
+		sections = append(sections, name)
+	}
+	for _, layer := range files {
+		for name, value := range layer.values {
+			if _, ok := value.(map[string]any); ok && name != profilesSection && !containsString(sections, name) {
+				sections = append(sections, name)
+			}
+		}
+	}
+
+	return sections
+}
+
+// mergeLayers merges layers into a config, the last one winning, and records
+// where each setting comes from.
+func mergeLayers(layers []*configLayer) (*configFile, error) {
+	merged := make(map[string]any)
+	origins := make(map[string]string)
+
+	for _, layer := range layers {
+		merged = mergeMaps(merged, layer.values)
+
+		// a table replacing a value, or the opposite, hides the origins of
+		// what it replaced
+		for path := range origins {
+			if _, ok := settingAt(merged, path); !ok {
+				delete(origins, path)
+			}
+		}
+		for path, origin := range layer.origins {
+			origins[path] = origin
+		}
+	}
+
+	var contents strings.Builder
+	if err := toml.NewEncoder(&contents).Encode(merged); err != nil {
+		return nil, err
+	}
+	config, err := parseConfig(contents.String())
+	if err != nil {
+		return nil, err
+	}
+	config.origins = origins
+
+	return config, nil
+}
+
+// settingAt returns the setting at a dotted path, tables excluded.
+func settingAt(values map[string]any, path string) (any, bool) {
+	key, rest, nested := strings.Cut(path, ".")
+	value, ok := values[key]
+	if !ok {
+		return nil, false
+	}
+
+	table, isTable := value.(map[string]any)
+	if !nested {
+		return value, !isTable
+	}
+	if !isTable {
+		return nil, false
+	}
+	return settingAt(table, rest)
+}
+
+// explained returns the config as redacted, with where each setting comes
+// from. The api keys found in the environment are included.
+func (file *configFile) explained() (map[string]any, map[string]string) {
+	values := file.redacted()
+
+	origins := make(map[string]string, len(file.origins))
+	for path, origin := range file.origins {
+		origins[path] = origin
+	}
+	if file.Provider == "" {
+		origins["provider"] = "first configured provider"
+	}
+
+	for name, value := range values {
+		section, ok := value.(map[string]any)
+		if _, isProvider := file.providerType(name); !ok || !isProvider || section["apikey"] != nil || section["apikey_cmd"] != nil {
+			continue
+		}
+		if key, env := file.apiKeyFromEnv(name); key != "" {
+			section["apikey"] = maskSecret(key)
+			origins[name+".apikey"] = "env " + env
+		}
+	}
+
+	return values, origins
+}
+
+// writeExplainedConfig writes values as toml, each setting followed by a
+// comment naming where it comes from.
+func writeExplainedConfig(w io.Writer, values map[string]any, origins map[string]string) error {
+	return writeExplainedTable(w, values, origins, "")
+}
+
+func writeExplainedTable(w io.Writer, values map[string]any, origins map[string]string, prefix string) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	var tables []string
+	for _, key := range keys {
+		if _, ok := values[key].(map[string]any); ok {
+			tables = append(tables, key)
+			continue
+		}
+
+		fmt.Fprintf(tw, "%s = %s", formatTOMLKey(key), formatTOMLValue(values[key]))
+		if origin := origins[prefix+key]; origin != "" {
+			fmt.Fprintf(tw, "\t# %s", origin)
+		}
+		fmt.Fprintln(tw)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, key := range tables {
+		name := prefix + formatTOMLKey(key)
+		if _, err := fmt.Fprintf(w, "\n[%s]\n", name); err != nil {
+			return err
+		}
+		if err := writeExplainedTable(w, values[key].(map[string]any), origins, prefix+key+"."); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoverConfigFiles(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+
+	project := filepath.Join(t.TempDir(), "project")
+	assert.NoError(t, os.MkdirAll(filepath.Join(project, "sub"), 0755))
+
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(filepath.Join(project, "sub")))
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	paths, err := discoverConfigFiles()
+	assert.NoError(t, err)
+	assert.Empty(t, paths)
+
+	write := func(path, contents string) string {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, os.WriteFile(path, []byte(contents), 0600))
+		return path
+	}
+	homeConfig := write(filepath.Join(home, ".sira.toml"), "apikey = 'home-key'\nprovider = 'openai'\n[openai]\nmodel = 'gpt-4'\n")
+	xdgConfig := write(filepath.Join(home, ".config", "sira", "config.toml"), "[openai]\nmodel = 'gpt-4o'\ntemperature = 0.5\n")
+	projectConfig := write(filepath.Join(project, ".sira.toml"), "provider = 'mistral'\n[mistral]\nmodel = 'mistral-small'\n")
+
+	paths, err = discoverConfigFiles()
+	assert.NoError(t, err)
+	resolved, _ := filepath.EvalSymlinks(projectConfig)
+	if assert.Len(t, paths, 3) {
+		assert.Equal(t, []string{homeConfig, xdgConfig}, paths[:2])
+		actual, _ := filepath.EvalSymlinks(paths[2])
+		assert.Equal(t, resolved, actual)
+	}
+
+	t.Setenv("SIRA_OPENAI_TEMPERATURE", "0.1")
+	t.Setenv("SIRA_MISTRAL_MAX_TOKENS", "100")
+	config, err := loadConfigFiles(paths)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "home-key", config.Apikey)
+	assert.Equal(t, "mistral", config.Provider)
+	assert.Equal(t, map[string]any{"model": "gpt-4o", "temperature": 0.5}, config.Section("openai"))
+	assert.Equal(t, map[string]any{"model": "mistral-small", "max_tokens": int64(100)}, config.Section("mistral"))
+
+	assert.Equal(t, homeConfig, config.origins["apikey"])
+	assert.Equal(t, xdgConfig, config.origins["openai.temperature"])
+	assert.Equal(t, paths[2], config.origins["provider"])
+	assert.Equal(t, "env SIRA_MISTRAL_MAX_TOKENS", config.origins["mistral.max_tokens"])
+}
+
+func TestEnvLayer(t *testing.T) {
+	layer := envLayer([]string{
+		"SIRA_PROVIDER=ollama",
+		"SIRA_APIKEY=sk-1",
+		"SIRA_OLLAMA_KEEP_ALIVE=5m",
+		"SIRA_HTTP_RETRIES=0",
+		"SIRA_PARAM_topic=food",
+		"OPENAI_API_KEY=sk-2",
+		"SIRA_=x",
+		"SIRA_VERSION=1",
+		"SIRA_HTTP_=x",
+		"SIRA_MY_LLAMA_MODEL=llama3",
+		"SIRA_MY_MODEL=other",
+	}, []string{"ollama", "http", "my", "my_llama"})
+
+	assert.Equal(t, map[string]any{
+		"provider": "ollama",
+		"apikey":   "sk-1",
+		"ollama":   map[string]any{"keep_alive": "5m"},
+		"http":     map[string]any{"retries": int64(0)},
+		"my_llama": map[string]any{"model": "llama3"},
+		"my":       map[string]any{"model": "other"},
+	}, layer.values)
+	assert.Equal(t, "env SIRA_OLLAMA_KEEP_ALIVE", layer.origins["ollama.keep_alive"])
+}
+
+func TestEnvSections(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	assert.NoError(t, os.WriteFile(path, []byte("provider = 'my_llama'\n[my_llama]\ntype = 'ollama'\n[profiles.fast]\nmodel = 'x'\n"), 0600))
+	t.Setenv("SIRA_VERSION", "1")
+	t.Setenv("SIRA_MY_LLAMA_MODEL", "llama3")
+	t.Setenv("SIRA_PROFILES_FAST_MODEL", "y")
+
+	config, err := loadConfigFiles([]string{path})
+	assert.NoError(t, err)
+	assert.Equal(t, "llama3", config.Section("my_llama")["model"])
+	assert.Equal(t, "env SIRA_MY_LLAMA_MODEL", config.origins["my_llama.model"])
+	assert.NotContains(t, config.sections, "version")
+	assert.NoError(t, config.validate())
+}
+
+func TestMergeLayersOrigins(t *testing.T) {
+	config, err := mergeLayers([]*configLayer{
+		{values: map[string]any{"openai": map[string]any{"headers": "x"}}, origins: map[string]string{"openai.headers": "a"}},
+		{values: map[string]any{"openai": map[string]any{"headers": map[string]any{"X-Key": "y"}}}, origins: map[string]string{"openai.headers.X-Key": "b"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"openai.headers.X-Key": "b"}, config.origins)
+}
+
+func TestAPIKey(t *testing.T) {
+	config, err := parseConfig(`
+apikey = "shared"
+
+[openai]
+model = "gpt-4"
+
+[mistral]
+apikey = "own"
+
+[groq]
+type = "openai"
+`)
+	assert.NoError(t, err)
+
+	apiKey := func(config *configFile, section string) string {
+		own, _ := config.Section(section)["apikey"].(string)
+		key, err := config.apiKey(section, own, "")
+		assert.NoError(t, err)
+		return key
+	}
+
+	assert.Equal(t, "shared", apiKey(config, "openai"))
+	assert.Equal(t, "own", apiKey(config, "mistral"))
+
+	t.Setenv("OPENAI_API_KEY", "from-the-environment")
+	assert.Equal(t, "from-the-environment", apiKey(config, "openai"))
+	assert.Equal(t, "from-the-environment", apiKey(config, "groq"))
+	assert.Equal(t, "shared", apiKey(config, "anthropic"))
+
+	values, origins := config.explained()
+	assert.Equal(t, "fro...ment", values["openai"].(map[string]any)["apikey"])
+	assert.Equal(t, "env OPENAI_API_KEY", origins["openai.apikey"])
+	assert.Equal(t, "first configured provider", origins["provider"])
+}
+
+func TestCLIConfigShow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	assert.NoError(t, os.WriteFile(path, []byte("apikey = 'sk-0123456789abcdef'\n[openai]\nmodel = 'gpt-4'\n[openai.headers]\nX-Custom = 'value'\n"), 0600))
+	t.Setenv("SIRA_OPENAI_TEMPERATURE", "0.3")
+
+	code, stdout, stderr := runSira(t, "", "--config", path, "config", "show", "--model", "gpt-4o")
+	assert.Equal(t, exitOK, code, stderr)
+	assert.Equal(t, strings.Join([]string{
+		`apikey = "sk-...cdef"  # ` + path,
+		`provider = "openai"    # first configured provider`,
+		``,
+		`[openai]`,
+		`model = "gpt-4o"   # --model`,
+		`temperature = 0.3  # env SIRA_OPENAI_TEMPERATURE`,
+		``,
+		`[openai.headers]`,
+		`X-Custom = "value"  # ` + path,
+		``,
+	}, "\n"), stdout)
+}
+
+func TestAPIKeyCommand(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "counter")
+	command := "echo run >> " + counter + "; echo '  sk-from-the-command  '"
+
+	config, err := parseConfig("apikey = 'shared'\n[mistral]\nmodel = 'mistral-tiny'\napikey_cmd = \"" + command + "\"\n")
+	assert.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		key, err := config.apiKey("mistral", "", config.Section("mistral")["apikey_cmd"].(string))
+		assert.NoError(t, err)
+		assert.Equal(t, "sk-from-the-command", key)
+	}
+	runs, err := os.ReadFile(counter)
+	assert.NoError(t, err)
+	assert.Equal(t, "run\n", string(runs), "the command runs once")
+
+	_, err = runSecretCommand("echo oops >&2; exit 3")
+	assert.ErrorContains(t, err, `apikey_cmd "echo oops >&2; exit 3" failed: exit status 3: oops`)
+
+	_, err = runSecretCommand("true")
+	assert.EqualError(t, err, `apikey_cmd "true" printed no key`)
+
+	config, err = parseConfig("apikey_cmd = 'exit 1'\n[openai]\nmodel = 'gpt-4'\n")
+	assert.NoError(t, err)
+	_, err = newProvider(config)
+	assert.ErrorContains(t, err, `apikey_cmd "exit 1" failed`)
+}
+
+func TestWorldReadableConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	assert.NoError(t, os.WriteFile(path, []byte("[openai]\nmodel = 'gpt-4'\napikey_cmd = 'echo sk'\n"), 0644))
+
+	_, err := loadConfigFiles([]string{path})
+	assert.NoError(t, err, "a command is not a secret")
+
+	assert.NoError(t, os.WriteFile(path, []byte("[openai]\nmodel = 'gpt-4'\napikey = 'sk-0123456789abcdef'\n"), 0644))
+	assert.NoError(t, os.Chmod(path, 0644))
+
+	code, _, stderr := runSira(t, "", "--config", path, "config", "show")
+	assert.Equal(t, exitError, code)
+	assert.Contains(t, stderr, path+" holds an api key and is readable by everyone, run chmod 600 "+path+" or use apikey_cmd")
+
+	assert.NoError(t, os.WriteFile(path, []byte("[profiles.fast]\nmodel = 'gpt-4o-mini'\napikey = 'sk-0123456789abcdef'\n"), 0644))
+	_, err = loadConfigFiles([]string{path})
+	assert.EqualError(t, err, path+" holds an api key and is readable by everyone, run chmod 600 "+path+" or use apikey_cmd")
+
+	assert.NoError(t, os.Chmod(path, 0600))
+	_, err = loadConfigFiles([]string{path})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// contextConfig is the [context] section of the config file, deciding how
+// much of a conversation is sent to the model.
+type contextConfig struct {
+	// Strategy is one of the contextStrategy constants.
+	Strategy string `toml:"strategy"`
+	// MaxMessages is the number of messages kept by the messages strategy,
+	// system messages aside.
+	MaxMessages int `toml:"max_messages"`
+	// ContextLength overrides the context length of the model, for models
+	// sira doesn't know.
+	ContextLength int `toml:"context_length"`
+	// Budget caps the tokens of the messages kept by the tokens strategy. It
+	// defaults to the context length of the model minus the max tokens of
+	// the answer.
+	Budget int `toml:"budget"`
+
+	// Summarize replaces the dropped messages with a summary written by
+	// SummaryModel of SummaryProvider, both defaulting to the ones of the
+	// conversation.
+	Summarize       bool   `toml:"summarize"`
+	SummaryProvider string `toml:"summary_provider"`
+	SummaryModel    string `toml:"summary_model"`
+	// SummaryTokens is the room left for the summary in the token budget.
+	SummaryTokens int `toml:"summary_tokens"`
+}
+
+func (config *contextConfig) summaryTokens() int {
+	if config.SummaryTokens > 0 {
+		return config.SummaryTokens
+	}
+	return defaultSummaryTokens
+}
+
+const (
+	// contextStrategy_Tokens keeps the latest messages fitting in the token
+	// budget. It is the default.
+	contextStrategy_Tokens = "tokens"
+	// contextStrategy_Messages keeps the latest max_messages messages.
+	contextStrategy_Messages = "messages"
+	// contextStrategy_None sends the whole conversation.
+	contextStrategy_None = "none"
+)
+
+func decodeContextConfig(section map[string]any) (*contextConfig, error) {
+	parsedConfig := new(contextConfig)
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:  parsedConfig,
+		TagName: "toml",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not create decoder: %w", err)
+	}
+
+	if err := decoder.Decode(section); err != nil {
+		return nil, fmt.Errorf("context: %w", err)
+	}
+
+	switch parsedConfig.Strategy {
+	case "":
+		parsedConfig.Strategy = contextStrategy_Tokens
+	case contextStrategy_Tokens, contextStrategy_None:
+	case contextStrategy_Messages:
+		if parsedConfig.MaxMessages <= 0 {
+			return nil, fmt.Errorf("context: max_messages must be positive with the %q strategy", contextStrategy_Messages)
+		}
+	default:
+		return nil, fmt.Errorf("context: unknown strategy %q, expected %q, %q or %q",
+			parsedConfig.Strategy, contextStrategy_Tokens, contextStrategy_Messages, contextStrategy_None)
+	}
+
+	if parsedConfig.ContextLength < 0 || parsedConfig.Budget < 0 {
+		return nil, fmt.Errorf("context: context_length and budget can't be negative")
+	}
+	if parsedConfig.SummaryTokens < 0 {
+		return nil, fmt.Errorf("context: summary_tokens can't be negative")
+	}
+
+	return parsedConfig, nil
+}
+
+// contextWindow selects the messages of a conversation sent to the model.
+// System messages are always kept, then the latest messages are kept until
+// the limit of the strategy is reached.
+type contextWindow struct {
+	strategy    string
+	maxMessages int
+	// budget is the number of tokens the messages can take, 0 for no limit.
+	budget int
+	// contextLength is the context length of the model, 0 when unknown.
+	contextLength int
+	model         string
+	tokenizer     tokenizer
+}
+
+// contextWindow returns the context window of the selected provider and
+// model.
+func (file *configFile) contextWindow() (*contextWindow, error) {
+	config, err := decodeContextConfig(file.Section("context"))
+	if err != nil {
+		return nil, err
+	}
+
+	selected, err := file.selectedProvider()
+	if err != nil {
+		return nil, err
+	}
+	kind, _ := file.providerType(selected)
+	section := file.Section(selected)
+	model, _ := section["model"].(string)
+
+	window := &contextWindow{
+		strategy:      config.Strategy,
+		maxMessages:   config.MaxMessages,
+		contextLength: config.ContextLength,
+		model:         model,
+		tokenizer:     tokenizerFor(model),
+	}
+	if info, ok := lookupModel(model); ok && window.contextLength == 0 {
+		window.contextLength = info.ContextLength
+	}
+
+	if config.Strategy == contextStrategy_Tokens {
+		if window.contextLength > 0 {
+			window.budget = window.contextLength - answerTokens(kind, section)
+		} else {
+			verboseLog.Printf("context: unknown context length of %q, set context_length in [context]", model)
+		}
+		if config.Budget > 0 && (window.budget <= 0 || config.Budget < window.budget) {
+			window.budget = config.Budget
+		}
+		if config.Summarize && window.budget > config.summaryTokens() {
+			window.budget -= config.summaryTokens()
+		}
+	}
+
+	return window, nil
+}
+
+// truncation is a conversation fitted in a context window.
+type truncation struct {
+	Kept    []Message
+	Dropped []Message
+	// Keep tells, for each message, whether it was kept.
+	Keep []bool
+	// Tokens is the estimated number of tokens of the kept messages.
+	Tokens int
+}
+
+// truncate drops the oldest messages not fitting in the window. System and
+// pinned messages are always kept, so is the last message, even when it
+// doesn't fit, and a truncated history starts with a user message, pinned or
+// not, as some apis require.
+func (w *contextWindow) truncate(messages []Message) *truncation {
+	keep := make([]bool, len(messages))
+	tokens := make([]int, len(messages))
+	used := tokensPerReply
+
+	for i, message := range messages {
+		tokens[i] = countMessageTokens(w.tokenizer, message)
+		if message.Role == "system" || message.Pinned {
+			keep[i] = true
+			used += tokens[i]
+		}
+	}
+
+	kept := 0
+	truncated := false
+	for i := len(messages) - 1; i >= 0; i-- {
+		if keep[i] {
+			continue
+		}
+
+		fits := true
+		switch w.strategy {
+		case contextStrategy_Messages:
+			fits = kept < w.maxMessages
+		case contextStrategy_Tokens:
+			fits = w.budget <= 0 || used+tokens[i] <= w.budget
+		}
+		if !fits && kept > 0 {
+			truncated = true
+			break
+		}
+
+		keep[i] = true
+		used += tokens[i]
+		kept++
+	}
+
+	for i := 0; truncated && i < len(messages); i++ {
+		if !keep[i] || messages[i].Role == "system" {
+			continue
+		}
+		if messages[i].Role == "user" {
+			break
+		}
+		if messages[i].Pinned {
+			continue
+		}
+		keep[i] = false
+		used -= tokens[i]
+	}
+
+	result := &truncation{Keep: keep, Tokens: used}
+	for i, message := range messages {
+		if keep[i] {
+			result.Kept = append(result.Kept, message)
+		} else {
+			result.Dropped = append(result.Dropped, message)
+		}
+	}
+
+	return result
+}
+
+// report prints what was dropped to the verbose log.
+func (w *contextWindow) report(t *truncation) {
+	if len(t.Dropped) == 0 {
+		return
+	}
+
+	limit := fmt.Sprintf("%d messages", w.maxMessages)
+	if w.strategy == contextStrategy_Tokens {
+		limit = fmt.Sprintf("%d tokens", w.budget)
+	}
+	verboseLog.Printf("context: dropped %d of %d messages to fit %s, sending ~%d tokens",
+		len(t.Dropped), len(t.Dropped)+len(t.Kept), limit, t.Tokens)
+
+	for _, message := range t.Dropped {
+		verboseLog.Printf("context:   %s, ~%d tokens: %s",
+			message.Role, countMessageTokens(w.tokenizer, message), preview(message.Content, 40))
+	}
+}
+
+// preview returns the first line of text, cut to n runes.
+func preview(text string, n int) string {
+	line, _, cut := strings.Cut(text, "\n")
+	runes := []rune(line)
+	if len(runes) > n {
+		runes, cut = runes[:n], true
+	}
+	if cut {
+		return string(runes) + "..."
+	}
+	return string(runes)
+}
+
+// answerTokens returns the max tokens of the answer set in the section of a
+// provider, or its default.
+func answerTokens(kind string, section map[string]any) int {
+	switch kind {
+	case "gemini":
+		generationConfig, _ := section["generation_config"].(map[string]any)
+		if maxTokens := intValue(generationConfig["max_output_tokens"]); maxTokens > 0 {
+			return maxTokens
+		}
+	case "ollama":
+		options, _ := section["options"].(map[string]any)
+		if maxTokens := intValue(options["num_predict"]); maxTokens > 0 {
+			return maxTokens
+		}
+	}
+
+	if maxTokens := intValue(section["max_tokens"]); maxTokens > 0 {
+		return maxTokens
+	}
+	if kind == "anthropic" {
+		return anthropicDefaultMaxTokens
+	}
+	return 0
+}
+
+// intValue returns the number decoded from toml or yaml, 0 for anything
+// else.
+func intValue(value any) int {
+	switch value := value.(type) {
+	case int:
+		return value
+	case int64:
+		return int(value)
+	case uint64:
+		return int(value)
+	case float64:
+		return int(value)
+	}
+	return 0
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fixedTokenizer counts a token per character.
+type fixedTokenizer struct{}
+
+func (fixedTokenizer) Name() string {
+	return "fixed"
+}
+
+func (fixedTokenizer) CountTokens(text string) int {
+	return len(text)
+}
+
+func TestTruncate(t *testing.T) {
+	messages := []Message{
+		{Role: "system", Content: "sys"},
+		{Role: "user", Content: "u1"},
+		{Role: "assistant", Content: "a1"},
+		{Role: "user", Content: "u2"},
+		{Role: "assistant", Content: "a2"},
+		{Role: "user", Content: "u3"},
+	}
+
+	t.Run("messages", func(t *testing.T) {
+		window := &contextWindow{strategy: contextStrategy_Messages, maxMessages: 3, tokenizer: fixedTokenizer{}}
+		result := window.truncate(messages)
+
+		// a1 would start the history, so it is dropped too
+		assert.Equal(t, []Message{messages[0], messages[3], messages[4], messages[5]}, result.Kept)
+		assert.Equal(t, []Message{messages[1], messages[2]}, result.Dropped)
+	})
+
+	t.Run("tokens", func(t *testing.T) {
+		// system is 3+4 tokens, every other message 2+4, and 3 for the reply
+		window := &contextWindow{strategy: contextStrategy_Tokens, budget: 3 + 4 + 3*6 + 3, tokenizer: fixedTokenizer{}}
+		result := window.truncate(messages)
+
+		assert.Equal(t, []Message{messages[0], messages[3], messages[4], messages[5]}, result.Kept)
+		assert.Equal(t, 3+4+3*6+3, result.Tokens)
+
+		window.budget += 6
+		result = window.truncate(messages)
+		assert.Equal(t, []Message{messages[0], messages[3], messages[4], messages[5]}, result.Kept)
+
+		window.budget += 6
+		result = window.truncate(messages)
+		assert.Equal(t, messages, result.Kept)
+		assert.Empty(t, result.Dropped)
+	})
+
+	t.Run("last message is always kept", func(t *testing.T) {
+		window := &contextWindow{strategy: contextStrategy_Tokens, budget: 1, tokenizer: fixedTokenizer{}}
+		result := window.truncate(messages)
+
+		assert.Equal(t, []Message{messages[0], messages[5]}, result.Kept)
+	})
+
+	t.Run("unknown budget or none", func(t *testing.T) {
+		for _, window := range []*contextWindow{
+			{strategy: contextStrategy_Tokens, tokenizer: fixedTokenizer{}},
+			{strategy: contextStrategy_None, tokenizer: fixedTokenizer{}},
+		} {
+			assert.Equal(t, messages, window.truncate(messages).Kept)
+		}
+	})
+
+	t.Run("a conversation can start with an assistant message", func(t *testing.T) {
+		window := &contextWindow{strategy: contextStrategy_Messages, maxMessages: 5, tokenizer: fixedTokenizer{}}
+		assert.Equal(t, messages[2:], window.truncate(messages[2:]).Kept)
+	})
+
+	t.Run("pinned messages are kept", func(t *testing.T) {
+		pinned := append([]Message{}, messages...)
+		pinned[2].Pinned = true
+
+		window := &contextWindow{strategy: contextStrategy_Messages, maxMessages: 1, tokenizer: fixedTokenizer{}}
+		result := window.truncate(pinned)
+
+		assert.Equal(t, []Message{pinned[0], pinned[2], pinned[5]}, result.Kept)
+		assert.Equal(t, []bool{true, false, true, false, false, true}, result.Keep)
+	})
+
+	t.Run("pinned first user message starts the history", func(t *testing.T) {
+		pinned := append([]Message{}, messages[1:]...)
+		pinned[0].Pinned = true
+
+		window := &contextWindow{strategy: contextStrategy_Messages, maxMessages: 2, tokenizer: fixedTokenizer{}}
+		result := window.truncate(pinned)
+
+		assert.Equal(t, []Message{pinned[0], pinned[3], pinned[4]}, result.Kept)
+		assert.Equal(t, []Message{pinned[1], pinned[2]}, result.Dropped)
+	})
+}
+
+func TestContextWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		strategy string
+		budget   int
+	}{
+		{"known model", "[openai]\nmodel = 'gpt-4-0613'\nmax_tokens = 500", contextStrategy_Tokens, 8192 - 500},
+		{"provider default max tokens", "[anthropic]\nmodel = 'claude-3-haiku-20240307'", contextStrategy_Tokens, 200000 - 1024},
+		{"gemini max tokens", "[gemini]\nmodel = 'gemini-1.5-flash'\n[gemini.generation_config]\nmax_output_tokens = 1000", contextStrategy_Tokens, 1048576 - 1000},
+		{"unknown model", "[openai]\nmodel = 'local'", contextStrategy_Tokens, 0},
+		{"context length", "[context]\ncontext_length = 4096\n[openai]\nmodel = 'local'\nmax_tokens = 96", contextStrategy_Tokens, 4000},
+		{"budget", "[context]\nbudget = 2000\n[openai]\nmodel = 'gpt-4o'", contextStrategy_Tokens, 2000},
+		{"messages", "[context]\nstrategy = 'messages'\nmax_messages = 4\n[openai]\nmodel = 'gpt-4o'", contextStrategy_Messages, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parseConfig(tt.config)
+			assert.NoError(t, err)
+
+			window, err := config.contextWindow()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.strategy, window.strategy)
+			assert.Equal(t, tt.budget, window.budget)
+		})
+	}
+
+	for config, expected := range map[string]string{
+		"[context]\nstrategy = 'last'":     `context: unknown strategy "last", expected "tokens", "messages" or "none"`,
+		"[context]\nstrategy = 'messages'": `context: max_messages must be positive with the "messages" strategy`,
+		"[context]\nbudget = -1":           "context: context_length and budget can't be negative",
+	} {
+		parsed, err := parseConfig(config + "\n[openai]\nmodel = 'gpt-4'")
+		assert.NoError(t, err)
+
+		_, err = parsed.contextWindow()
+		assert.EqualError(t, err, expected)
+	}
+}
+
+func TestChatTruncatesContext(t *testing.T) {
+	config, received := newOllamaConfig(t)
+
+	conversation := `---
+context:
+  strategy: messages
+  max_messages: 1
+---
+# system
+Be brief.
+
+# user
+first question
+
+# assistant
+first answer
+
+# user
+second question
+`
+	filename := filepath.Join(t.TempDir(), "chat.md")
+	assert.NoError(t, os.WriteFile(filename, []byte(conversation), 0644))
+
+	code, _, stderr := runSira(t, "", "--config", config, "--verbose", filename)
+	assert.Equal(t, exitOK, code, stderr)
+	assert.Contains(t, stderr, "context: dropped 2 of 4 messages to fit 1 messages")
+	assert.Contains(t, stderr, "context:   user, ~8 tokens: first question\n")
+
+	if assert.Len(t, *received, 1) {
+		assert.Equal(t, []ollamaMessage{
+			{Role: "system", Content: "Be brief."},
+			{Role: "user", Content: "second question"},
+		}, (*received)[0].Messages)
+	}
+}
+
+func TestChatMessageAnnotations(t *testing.T) {
+	config, received := newOllamaConfig(t)
+
+	conversation := `# system
+Be brief.
+
+# user (pin)
+first question
+
+# assistant (skip)
+wrong answer
+
+# user
+second question
+
+# assistant
+second answer
+
+# user {model = "mistral", options = {temperature = 0.1}}
+third question
+`
+	filename := filepath.Join(t.TempDir(), "chat.md")
+	assert.NoError(t, os.WriteFile(filename, []byte("---\ncontext:\n  strategy: messages\n  max_messages: 1\n---\n"+conversation), 0644))
+
+	code, _, stderr := runSira(t, "", "--config", config, filename)
+	assert.Equal(t, exitOK, code, stderr)
+
+	if assert.Len(t, *received, 1) {
+		assert.Equal(t, "mistral", (*received)[0].Model)
+		assert.Equal(t, map[string]any{"temperature": 0.1}, (*received)[0].Options)
+		assert.Equal(t, []ollamaMessage{
+			{Role: "system", Content: "Be brief."},
+			{Role: "user", Content: "first question"},
+			{Role: "user", Content: "third question"},
+		}, (*received)[0].Messages)
+	}
+
+	// the next turn is back to the config
+	code, _, stderr = runSira(t, "", "--config", config, filename)
+	assert.Equal(t, exitOK, code, stderr)
+	if assert.Len(t, *received, 2) {
+		assert.Equal(t, "llama2", (*received)[1].Model)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Values decodes the front matter into a map.
+func (node *FrontMatterNode) Values() (map[string]any, error) {
+	values := make(map[string]any)
+
+	switch node.Format {
+	case "toml":
+		if _, err := toml.Decode(node.Raw, &values); err != nil {
+			return nil, fmt.Errorf("%v: invalid toml front matter: %w", node.Span.Start, err)
+		}
+	case "yaml":
+		if err := yaml.Unmarshal([]byte(node.Raw), &values); err != nil {
+			return nil, fmt.Errorf("%v: invalid yaml front matter: %w", node.Span.Start, err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown front matter format %q", node.Format)
+	}
+
+	return values, nil
+}
+
+// credentialKeys are the settings holding or producing an api key.
+var credentialKeys = []string{"apikey", "apikey_cmd"}
+
+// connectionKeys are the settings telling where and how a provider is
+// reached, which the api key is sent to.
+var connectionKeys = []string{"base_url", "headers", "no_auth", "organization", "stream_usage", "type", "version"}
+
+// configOnlySections are the sections a conversation may not override.
+var configOnlySections = []string{"http", "usage", profilesSection}
+
+// withDocumentOverrides is withOverrides for the settings of a conversation,
+// its front matter or the header of a message. A conversation can be shared,
+// so it only overrides the model and the generation settings: the
+// credentials and the connection come from the config files, so opening a
+// conversation neither runs a command nor sends the api key elsewhere.
+func (file *configFile) withDocumentOverrides(overrides map[string]any) (*configFile, error) {
+	if err := checkDocumentOverrides(overrides, ""); err != nil {
+		return nil, err
+	}
+	return file.withOverrides(overrides)
+}
+
+// checkDocumentOverrides returns an error for the first setting of
+// overrides a conversation may not set, tables included.
+func checkDocumentOverrides(overrides map[string]any, prefix string) error {
+	keys := make([]string, 0, len(overrides))
+	for key := range overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if containsString(credentialKeys, key) || containsString(connectionKeys, key) || (prefix == "" && containsString(configOnlySections, key)) {
+			return fmt.Errorf("%s%s can only be set in the config, not in a conversation", prefix, key)
+		}
+		if table, ok := overrides[key].(map[string]any); ok {
+			if err := checkDocumentOverrides(table, prefix+key+"."); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// withOverrides returns a copy of the config with the settings of a file
+// front matter applied on top of it:
+//
+//   - "provider" selects the provider, like the top level key of the config
+//   - "profile" is skipped, profiles are applied first by withProfile
+//   - a table named after a config section is merged into that section
+//   - any other key is merged into the section of the selected provider
+//
+// So a front matter setting wins over the config file, which wins over the
+// provider defaults.
+func (file *configFile) withOverrides(overrides map[string]any) (*configFile, error) {
+	if len(overrides) == 0 {
+		return file, nil
+	}
+
+	merged := *file
+	merged.sections = make(map[string]map[string]any, len(file.sections))
+	for name, section := range file.sections {
+		merged.sections[name] = section
+	}
+
+	if provider, ok := overrides["provider"]; ok {
+		name, ok := provider.(string)
+		if !ok {
+			return nil, fmt.Errorf("front matter: provider must be a string, got %T", provider)
+		}
+		merged.Provider = name
+	}
+
+	selected, err := merged.selectedProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range overrides {
+		if key == "provider" || key == "profile" {
+			continue
+		}
+
+		if table, ok := value.(map[string]any); ok && merged.isSectionName(key) {
+			merged.sections[key] = mergeMaps(merged.sections[key], table)
+			continue
+		}
+
+		merged.sections[selected] = mergeMaps(merged.sections[selected], map[string]any{key: value})
+	}
+
+	return &merged, nil
+}
+
+// isSectionName reports whether name is a config section, a provider or the
+// [context] section.
+func (file *configFile) isSectionName(name string) bool {
+	if _, ok := file.sections[name]; ok || name == "context" || name == "usage" {
+		return true
+	}
+	_, ok := providers[name]
+	return ok
+}
+
+// mergeMaps returns a new map with the keys of override set on top of base.
+// Nested maps are merged recursively.
+func mergeMaps(base, override map[string]any) map[string]any {
+	merged := make(map[string]any, len(base)+len(override))
+	for k, v := range base {
+		merged[k] = v
+	}
+
+	for k, v := range override {
+		baseTable, baseIsTable := merged[k].(map[string]any)
+		overrideTable, overrideIsTable := v.(map[string]any)
+		if baseIsTable && overrideIsTable {
+			merged[k] = mergeMaps(baseTable, overrideTable)
+			continue
+		}
+		merged[k] = v
+	}
+
+	return merged
+}
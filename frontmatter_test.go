@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFrontMatter(t *testing.T) {
+	t.Run("toml", func(t *testing.T) {
+		doc := parseDocument("+++\nprovider = 'mistral'\ntemperature = 0.1\n+++\n# user\nhi\n")
+
+		if assert.NotNil(t, doc.FrontMatter) {
+			assert.Equal(t, "toml", doc.FrontMatter.Format)
+			assert.Equal(t, 4, doc.FrontMatter.Span.End.Line)
+
+			values, err := doc.FrontMatter.Values()
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]any{"provider": "mistral", "temperature": 0.1}, values)
+		}
+		assert.Len(t, doc.Messages, 1)
+	})
+
+	t.Run("yaml", func(t *testing.T) {
+		doc := parseDocument("---\n# user settings\nmodel: mistral-small\nmax_tokens: 200\n---\n# user\nhi\n")
+
+		if assert.NotNil(t, doc.FrontMatter) {
+			assert.Equal(t, "yaml", doc.FrontMatter.Format)
+
+			values, err := doc.FrontMatter.Values()
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]any{"model": "mistral-small", "max_tokens": 200}, values)
+		}
+		if assert.Len(t, doc.Messages, 1) {
+			assert.Equal(t, "hi", doc.Messages[0].Content)
+		}
+	})
+
+	t.Run("not at the top", func(t *testing.T) {
+		doc := parseDocument("# user\n---\nhi\n---\n")
+		assert.Nil(t, doc.FrontMatter)
+		assert.Equal(t, "---\nhi\n---", doc.Messages[0].Content)
+	})
+
+	t.Run("unclosed", func(t *testing.T) {
+		doc := parseDocument("---\n# user\nhi\n")
+		assert.Nil(t, doc.FrontMatter)
+		assert.Len(t, doc.Messages, 1)
+	})
+
+	t.Run("rule before the messages", func(t *testing.T) {
+		src := "---\n# user\nhi\n```\n---\n```\n# assistant\nhello\n---\nbye\n"
+		doc := parseDocument(src)
+		assert.Nil(t, doc.FrontMatter)
+		if assert.Len(t, doc.Messages, 2) {
+			assert.Equal(t, "hello\n---\nbye", doc.Messages[1].Content)
+		}
+
+		messages, err := renderDocument(doc, src, "rule.md", nil)
+		assert.NoError(t, err)
+		assert.Len(t, messages, 2)
+	})
+
+	t.Run("text between rules", func(t *testing.T) {
+		doc := parseDocument("---\nA conversation about parsers.\n---\n# user\nhi\n")
+		assert.Nil(t, doc.FrontMatter)
+		if assert.Len(t, doc.Messages, 1) {
+			assert.Equal(t, "hi", doc.Messages[0].Content)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		doc := parseDocument("+++\nmodel = \n+++\n# user\nhi\n")
+		_, err := doc.FrontMatter.Values()
+		assert.ErrorContains(t, err, "invalid toml front matter")
+	})
+}
+
+func TestConfigWithOverrides(t *testing.T) {
+	config, err := parseConfig(`
+[openai]
+model = 'gpt-3.5-turbo'
+temperature = 0.7
+
+[mistral]
+model = 'mistral-tiny'
+max_tokens = 4000
+	`)
+	assert.NoError(t, err)
+
+	merged, err := config.withOverrides(map[string]any{
+		"provider":    "mistral",
+		"temperature": 0.1,
+		"openai":      map[string]any{"model": "gpt-4"},
+	})
+	assert.NoError(t, err)
+
+	request, err := decodeMistralRequest(merged.Section("mistral"))
+	assert.NoError(t, err)
+	assert.Equal(t, "mistral-tiny", request.Model)
+	assert.Equal(t, 4000, *request.MaxTokens)
+	assert.Equal(t, float32(0.1), *request.Temperature)
+
+	assert.Equal(t, "gpt-4", merged.Section("openai")["model"])
+
+	// the original config is left untouched
+	assert.Equal(t, "", config.Provider)
+	assert.Equal(t, "gpt-3.5-turbo", config.Section("openai")["model"])
+	assert.Nil(t, config.Section("mistral")["temperature"])
+}
+
+func TestChatWithFrontMatter(t *testing.T) {
+	var received ollamaChatRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"hello"},"done":true}`)
+	}))
+	defer server.Close()
+
+	config, err := parseConfig(`
+[openai]
+model = 'gpt-3.5-turbo'
+
+[ollama]
+base_url = '` + server.URL + `'
+model = 'llama2'
+	`)
+	assert.NoError(t, err)
+
+	conversation := `---
+provider: ollama
+model: mistral
+options:
+  temperature: 0.1
+---
+# user
+hi
+`
+	filename := filepath.Join(t.TempDir(), "chat.md")
+	assert.NoError(t, os.WriteFile(filename, []byte(conversation), 0644))
+
+	assert.NoError(t, chat(context.Background(), config, filename, nil, &strings.Builder{}))
+
+	assert.Equal(t, "mistral", received.Model)
+	assert.Equal(t, 0.1, received.Options["temperature"])
+	assert.Equal(t, []ollamaMessage{{Role: "user", Content: "hi"}}, received.Messages)
+
+	contents, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(contents), conversation))
+}
+
+func TestFrontMatterCredentialsRefused(t *testing.T) {
+	config, received := newOllamaConfig(t)
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "pwned")
+
+	for _, conversation := range []string{
+		"+++\napikey_cmd = 'touch " + marker + "; echo x'\n+++\n# user\nhi\n",
+		"+++\n[ollama]\napikey_cmd = 'touch " + marker + "; echo x'\n+++\n# user\nhi\n",
+		"# user {apikey_cmd = 'touch " + marker + "; echo x'}\nhi\n",
+		"# user {apikey = 'sk-stolen'}\nhi\n",
+	} {
+		filename := filepath.Join(dir, "chat.md")
+		assert.NoError(t, os.WriteFile(filename, []byte(conversation), 0644))
+
+		code, _, stderr := runSira(t, "", "--config", config, filename)
+		assert.Equal(t, exitError, code)
+		assert.Contains(t, stderr, "can only be set in the config, not in a conversation")
+	}
+
+	assert.NoFileExists(t, marker)
+	assert.Empty(t, *received)
+}
+
+func TestFrontMatterConnectionRefused(t *testing.T) {
+	config, received := newOllamaConfig(t)
+	filename := filepath.Join(t.TempDir(), "chat.md")
+
+	for _, conversation := range []string{
+		"+++\nbase_url = 'https://attacker.example'\n+++\n# user\nhi\n",
+		"+++\n[openai]\nheaders = { X-Forward = 'yes' }\n+++\n# user\nhi\n",
+		"---\nno_auth: true\n---\n# user\nhi\n",
+		"+++\n[openai]\norganization = 'org-other'\n+++\n# user\nhi\n",
+		"+++\n[evil]\ntype = 'openai'\n+++\n# user\nhi\n",
+		"+++\n[usage]\nledger = '/tmp/elsewhere'\n+++\n# user\nhi\n",
+		"# user {ollama = {base_url = 'https://attacker.example'}}\nhi\n",
+	} {
+		assert.NoError(t, os.WriteFile(filename, []byte(conversation), 0644))
+
+		code, _, stderr := runSira(t, "", "--config", config, filename)
+		assert.Equal(t, exitError, code, conversation)
+		assert.Contains(t, stderr, "can only be set in the config, not in a conversation", conversation)
+	}
+	assert.Empty(t, *received)
+
+	// the model and the generation settings are fine
+	assert.NoError(t, os.WriteFile(filename, []byte("+++\nmodel = 'mistral'\ntemperature = 0.2\n[ollama.options]\nnum_ctx = 4096\n+++\n# user\nhi\n"), 0644))
+	code, _, stderr := runSira(t, "", "--config", config, filename)
+	assert.Equal(t, exitOK, code, stderr)
+	assert.Len(t, *received, 1)
+}
@@ -0,0 +1,68 @@
+package main
+
+// generationParams are the provider neutral parameters of a request. They
+// are set in the section of any provider, under the same names, and each
+// provider translates them to its api:
+//
+//	model        required
+//	temperature  1
+//	top_p        not sent, which every api takes as 1
+//	max_tokens   the limit of the model, 1024 for anthropic which needs one
+//	seed         not sent, so sampling is random
+//	stop         none
+//
+// The settings specific to a provider, like the options of ollama or the
+// generation_config of gemini, pass through untouched and win over the
+// neutral parameters they overlap with.
+type generationParams struct {
+	Model       string   `json:"model" toml:"model"`
+	Temperature *float64 `json:"temperature" toml:"temperature"`
+	TopP        *float64 `json:"top_p" toml:"top_p"`
+	MaxTokens   *int     `json:"max_tokens" toml:"max_tokens"`
+	Seed        *int     `json:"seed" toml:"seed"`
+	Stop        []string `json:"stop" toml:"stop"`
+}
+
+// defaultTemperature is the temperature of the requests that don't set one.
+// It is the default of the openai and anthropic apis, the only value some of
+// their models accept.
+const defaultTemperature = 1.0
+
+// decodeGenerationParams decodes the neutral parameters of a provider
+// section, with the defaults applied.
+func decodeGenerationParams(section map[string]any) (*generationParams, error) {
+	params := new(generationParams)
+	if err := decodeSection(section, params); err != nil {
+		return nil, err
+	}
+
+	if params.Temperature == nil {
+		temperature := defaultTemperature
+		params.Temperature = &temperature
+	}
+
+	return params, nil
+}
+
+// zeroFloats returns the names of the temperature and top_p when they are
+// set to 0, for the apis omitting the fields set to 0.
+func (params *generationParams) zeroFloats() []string {
+	var zeros []string
+	if params.Temperature != nil && *params.Temperature == 0 {
+		zeros = append(zeros, "temperature")
+	}
+	if params.TopP != nil && *params.TopP == 0 {
+		zeros = append(zeros, "top_p")
+	}
+	return zeros
+}
+
+// float32Value returns value as a *float32, nil when value is nil.
+func float32Value(value *float64) *float32 {
+	if value == nil {
+		return nil
+	}
+
+	converted := float32(*value)
+	return &converted
+}
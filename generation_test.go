@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sentRequest sends a conversation to the provider of the given kind, with
+// the settings of section, and returns the body of the request it sent.
+func sentRequest(t *testing.T, kind, section string) map[string]any {
+	var body map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		http.Error(w, `{"error":{"message":"nope"}}`, http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	baseURL := server.URL
+	if kind == "openai" {
+		baseURL += "/v1"
+	}
+
+	config, err := parseConfig("apikey = 'sk-1234567890'\n[" + kind + "]\nbase_url = '" + baseURL + "'\n" + section)
+	assert.NoError(t, err)
+	assert.NoError(t, config.validate())
+
+	provider, err := newProvider(config)
+	assert.NoError(t, err)
+
+	_, err = provider.ChatStream(context.Background(), []Message{{Role: "user", Content: "hi"}}, func(string) {})
+	assert.Error(t, err)
+
+	return body
+}
+
+func TestGenerationParams(t *testing.T) {
+	section := `
+model = 'some-model'
+temperature = 0.2
+top_p = 0.9
+max_tokens = 100
+seed = 42
+stop = ['END']
+`
+
+	body := sentRequest(t, "openai", section)
+	assert.Equal(t, 0.2, body["temperature"])
+	assert.Equal(t, 0.9, body["top_p"])
+	assert.Equal(t, 100.0, body["max_tokens"])
+	assert.Equal(t, 42.0, body["seed"])
+	assert.Equal(t, []any{"END"}, body["stop"])
+
+	body = sentRequest(t, "mistral", section)
+	assert.Equal(t, 0.2, body["temperature"])
+	assert.Equal(t, 0.9, body["top_p"])
+	assert.Equal(t, 100.0, body["max_tokens"])
+	assert.Equal(t, 42.0, body["random_seed"])
+	assert.Equal(t, []any{"END"}, body["stop"])
+
+	body = sentRequest(t, "anthropic", section)
+	assert.Equal(t, 0.2, body["temperature"])
+	assert.Equal(t, 0.9, body["top_p"])
+	assert.Equal(t, 100.0, body["max_tokens"])
+	assert.Equal(t, []any{"END"}, body["stop_sequences"])
+
+	body = sentRequest(t, "gemini", section)
+	assert.Equal(t, map[string]any{
+		"temperature":     0.2,
+		"topP":            0.9,
+		"maxOutputTokens": 100.0,
+		"seed":            42.0,
+		"stopSequences":   []any{"END"},
+	}, body["generationConfig"])
+
+	body = sentRequest(t, "ollama", section)
+	assert.Equal(t, map[string]any{
+		"temperature": 0.2,
+		"top_p":       0.9,
+		"num_predict": 100.0,
+		"seed":        42.0,
+		"stop":        []any{"END"},
+	}, body["options"])
+}
+
+func TestGenerationParamsDefaults(t *testing.T) {
+	section := "model = 'some-model'\n"
+
+	body := sentRequest(t, "openai", section)
+	assert.Equal(t, 1.0, body["temperature"])
+	assert.NotContains(t, body, "top_p")
+	assert.NotContains(t, body, "max_tokens")
+	assert.NotContains(t, body, "seed")
+
+	body = sentRequest(t, "mistral", section)
+	assert.Equal(t, 1.0, body["temperature"])
+	assert.Nil(t, body["max_tokens"])
+	assert.Nil(t, body["top_p"])
+	assert.NotContains(t, body, "safe_mode")
+	assert.NotContains(t, body, "random_seed")
+
+	body = sentRequest(t, "anthropic", section)
+	assert.Equal(t, 1.0, body["temperature"])
+	assert.Equal(t, float64(anthropicDefaultMaxTokens), body["max_tokens"])
+
+	body = sentRequest(t, "gemini", section)
+	assert.Equal(t, map[string]any{"temperature": 1.0}, body["generationConfig"])
+
+	body = sentRequest(t, "ollama", section)
+	assert.Equal(t, map[string]any{"temperature": 1.0}, body["options"])
+}
+
+func TestGenerationParamsExtras(t *testing.T) {
+	// the settings of a provider win over the neutral ones they overlap with
+	body := sentRequest(t, "mistral", "model = 'some-model'\nseed = 1\nrandom_seed = 2\nsafe_mode = true\n")
+	assert.Equal(t, 2.0, body["random_seed"])
+	assert.Equal(t, true, body["safe_mode"])
+
+	body = sentRequest(t, "ollama", "model = 'some-model'\nmax_tokens = 100\noptions = { num_predict = 50, num_ctx = 4096 }\n")
+	assert.Equal(t, map[string]any{"temperature": 1.0, "num_predict": 50.0, "num_ctx": 4096.0}, body["options"])
+
+	body = sentRequest(t, "gemini", "model = 'some-model'\ntemperature = 0.5\ngeneration_config = { temperature = 0.1, top_k = 3 }\n")
+	assert.Equal(t, map[string]any{"temperature": 0.1, "topK": 3.0}, body["generationConfig"])
+
+	// go-openai omits the fields set to 0, which are sent anyway
+	body = sentRequest(t, "openai", "model = 'some-model'\ntemperature = 0.0\ntop_p = 0.0\n")
+	assert.Equal(t, 0.0, body["temperature"])
+	assert.Equal(t, 0.0, body["top_p"])
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// httpConfig is the [http] section of the config file, shared by all
+// providers.
+type httpConfig struct {
+	// Retries is the number of times a request failed with 429 or 5xx is
+	// retried, 0 disables retries.
+	Retries *int `toml:"retries"`
+	// RetryBaseDelay is the delay before the first retry, doubled on every
+	// attempt up to RetryMaxDelay. A Retry-After header takes precedence, and
+	// the request is not retried when it asks to wait for longer than
+	// RetryMaxDelay.
+	RetryBaseDelay time.Duration `toml:"retry_base_delay"`
+	RetryMaxDelay  time.Duration `toml:"retry_max_delay"`
+
+	ConnectTimeout time.Duration `toml:"connect_timeout"`
+	// Timeout is the overall deadline of a request, retries and streaming
+	// included.
+	Timeout time.Duration `toml:"timeout"`
+	// IdleTimeout is the maximum time to wait for the response headers and
+	// between two chunks of a streamed response.
+	IdleTimeout time.Duration `toml:"idle_timeout"`
+}
+
+const defaultRetries = 2
+
+var defaultHTTPConfig = httpConfig{
+	RetryBaseDelay: 500 * time.Millisecond,
+	RetryMaxDelay:  30 * time.Second,
+	ConnectTimeout: 10 * time.Second,
+	Timeout:        10 * time.Minute,
+	IdleTimeout:    2 * time.Minute,
+}
+
+// withDefaults fills the unset fields with the defaults.
+func (c httpConfig) withDefaults() httpConfig {
+	if c.Retries == nil {
+		retries := defaultRetries
+		c.Retries = &retries
+	}
+	if c.RetryBaseDelay == 0 {
+		c.RetryBaseDelay = defaultHTTPConfig.RetryBaseDelay
+	}
+	if c.RetryMaxDelay == 0 {
+		c.RetryMaxDelay = defaultHTTPConfig.RetryMaxDelay
+	}
+	if c.ConnectTimeout == 0 {
+		c.ConnectTimeout = defaultHTTPConfig.ConnectTimeout
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultHTTPConfig.Timeout
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = defaultHTTPConfig.IdleTimeout
+	}
+
+	return c
+}
+
+// newHTTPClient returns the client every provider uses to talk to its api.
+func (file *configFile) newHTTPClient() *http.Client {
+	config := file.HTTP.withDefaults()
+
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.DialContext = (&net.Dialer{
+		Timeout:   config.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+
+	return &http.Client{
+		Timeout: config.Timeout,
+		Transport: &retryTransport{
+			base:   base,
+			config: config,
+		},
+	}
+}
+
+// ErrIdleTimeout is returned when a provider stops sending data for longer
+// than the configured idle timeout.
+var ErrIdleTimeout = errors.New("the provider stopped responding")
+
+// retryTransport retries requests failed with 429 or 5xx with a jittered
+// exponential backoff, and aborts requests whose response stalls.
+type retryTransport struct {
+	base   http.RoundTripper
+	config httpConfig
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.Body != nil {
+			if req.GetBody == nil {
+				return nil, errors.New("cannot retry a request without GetBody")
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		res, err := t.roundTrip(req)
+		if err != nil || !isRetryable(res.StatusCode) || attempt >= *t.config.Retries {
+			return res, err
+		}
+
+		delay, ok := t.backoff(attempt, res.Header.Get("Retry-After"))
+		if !ok {
+			return res, nil
+		}
+		io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+		res.Body.Close()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// roundTrip does a single attempt, cancelling it if no data is received for
+// longer than the idle timeout.
+func (t *retryTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	watchdog := &idleWatchdog{cancel: cancel}
+	watchdog.timer = time.AfterFunc(t.config.IdleTimeout, watchdog.fire)
+
+	res, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		watchdog.stop()
+		cancel()
+		if watchdog.fired() {
+			return nil, fmt.Errorf("%w: no response after %v", ErrIdleTimeout, t.config.IdleTimeout)
+		}
+		return nil, err
+	}
+
+	res.Body = &idleTimeoutBody{
+		body:     res.Body,
+		watchdog: watchdog,
+		timeout:  t.config.IdleTimeout,
+	}
+
+	return res, nil
+}
+
+func isRetryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// backoff returns the delay before the next attempt. retryAfter is honored
+// when set, otherwise the delay doubles on every attempt, with jitter. It
+// returns false when retryAfter is longer than the max delay, so the request
+// is not retried.
+func (t *retryTransport) backoff(attempt int, retryAfter string) (time.Duration, bool) {
+	if delay, ok := parseRetryAfter(retryAfter, time.Now()); ok {
+		return delay, delay <= t.config.RetryMaxDelay
+	}
+
+	delay := t.config.RetryBaseDelay << attempt
+	if delay > t.config.RetryMaxDelay || delay <= 0 {
+		delay = t.config.RetryMaxDelay
+	}
+
+	// keep between half and the full delay
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1)), true
+}
+
+// parseRetryAfter parses a Retry-After header, either in seconds or as an
+// http date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		delay := date.Sub(now)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+
+	return 0, false
+}
+
+// idleWatchdog cancels a request when its timer fires.
+type idleWatchdog struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	didFire bool
+}
+
+func (w *idleWatchdog) fire() {
+	w.mu.Lock()
+	w.didFire = true
+	w.mu.Unlock()
+
+	w.cancel()
+}
+
+func (w *idleWatchdog) fired() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.didFire
+}
+
+func (w *idleWatchdog) stop() {
+	w.timer.Stop()
+}
+
+// idleTimeoutBody restarts the watchdog of its request on every read.
+type idleTimeoutBody struct {
+	body     io.ReadCloser
+	watchdog *idleWatchdog
+	timeout  time.Duration
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if b.watchdog.fired() {
+		return n, fmt.Errorf("%w: no data for %v", ErrIdleTimeout, b.timeout)
+	}
+	if n > 0 {
+		b.watchdog.timer.Reset(b.timeout)
+	}
+
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.watchdog.stop()
+	b.watchdog.cancel()
+
+	return b.body.Close()
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	delay, ok := parseRetryAfter("3", now)
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, delay)
+
+	delay, ok = parseRetryAfter("Mon, 01 Jan 2024 12:00:10 GMT", now)
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Second, delay)
+
+	_, ok = parseRetryAfter("soon", now)
+	assert.False(t, ok)
+	_, ok = parseRetryAfter("", now)
+	assert.False(t, ok)
+}
+
+func TestBackoff(t *testing.T) {
+	transport := &retryTransport{config: httpConfig{
+		RetryBaseDelay: 100 * time.Millisecond,
+		RetryMaxDelay:  time.Second,
+	}}
+
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		delay, ok := transport.backoff(attempt, "")
+		assert.True(t, ok)
+		assert.GreaterOrEqual(t, delay, max/2)
+		assert.LessOrEqual(t, delay, max)
+	}
+
+	delay, ok := transport.backoff(0, "1")
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, delay)
+
+	// waiting longer than the max delay is not worth it
+	_, ok = transport.backoff(0, "2")
+	assert.False(t, ok)
+}
+
+// newFaultyConfig returns an ollama config pointing to server with fast
+// retries and short timeouts.
+func newFaultyConfig(t *testing.T, server *httptest.Server, extra string) *configFile {
+	config, err := parseConfig(`
+[http]
+retries = 3
+retry_base_delay = '1ms'
+retry_max_delay = '5ms'
+idle_timeout = '200ms'
+` + extra + `
+
+[ollama]
+base_url = '` + server.URL + `'
+model = 'llama2'
+	`)
+	assert.NoError(t, err)
+
+	return config
+}
+
+func chatOnce(t *testing.T, config *configFile) (*Completion, error) {
+	provider, err := newProvider(config)
+	assert.NoError(t, err)
+
+	return provider.ChatStream(context.Background(), []Message{{Role: "user", Content: "hi"}}, func(string) {})
+}
+
+const ollamaDone = `{"message":{"role":"assistant","content":"ok"},"done":true}` + "\n"
+
+func TestRetryOnServerErrors(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&attempts, 1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			fmt.Fprint(w, ollamaDone)
+		}
+	}))
+	defer server.Close()
+
+	completion, err := chatOnce(t, newFaultyConfig(t, server, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", completion.Message.Content)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, `{"error":"upstream down"}`)
+	}))
+	defer server.Close()
+
+	_, err := chatOnce(t, newFaultyConfig(t, server, ""))
+
+	var apiErr *APIError
+	assert.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusBadGateway, apiErr.StatusCode)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&attempts))
+}
+
+func TestNoRetryAfterMaxDelay(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"error":"rate limited"}`)
+	}))
+	defer server.Close()
+
+	_, err := chatOnce(t, newFaultyConfig(t, server, ""))
+
+	var apiErr *APIError
+	assert.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusTooManyRequests, apiErr.StatusCode)
+	assert.Equal(t, "3600", apiErr.RetryAfter)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+}
+
+func TestNoRetryOnClientErrors(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	_, err := chatOnce(t, newFaultyConfig(t, server, ""))
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+}
+
+func TestStalledStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"Hel"},"done":false}`)
+		w.(http.Flusher).Flush()
+
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	_, err := chatOnce(t, newFaultyConfig(t, server, ""))
+	assert.ErrorIs(t, err, ErrIdleTimeout)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestSlowHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server only notices the client went away once the body is read
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	_, err := chatOnce(t, newFaultyConfig(t, server, ""))
+	assert.ErrorIs(t, err, ErrIdleTimeout)
+}
+
+func TestOverallTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// keep sending data so the idle timeout never fires
+		for {
+			fmt.Fprintln(w, `{"message":{"role":"assistant","content":"."},"done":false}`)
+			w.(http.Flusher).Flush()
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	_, err := chatOnce(t, newFaultyConfig(t, server, "timeout = '300ms'"))
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestRetryThroughProviderClients(t *testing.T) {
+	for _, provider := range []string{"openai", "mistral"} {
+		t.Run(provider, func(t *testing.T) {
+			var attempts int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&attempts, 1) == 1 {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+
+				w.Header().Set("Content-Type", "text/event-stream")
+				fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"ok\"}}]}\n\n")
+				fmt.Fprint(w, "data: [DONE]\n\n")
+			}))
+			defer server.Close()
+
+			config, err := parseConfig(`
+provider = '` + provider + `'
+
+[http]
+retry_base_delay = '1ms'
+
+[` + provider + `]
+base_url = '` + server.URL + `'
+model = 'some-model'
+			`)
+			assert.NoError(t, err)
+
+			completion, err := chatOnce(t, config)
+			assert.NoError(t, err)
+			assert.Equal(t, "ok", completion.Message.Content)
+			assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+		})
+	}
+}
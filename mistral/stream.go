@@ -0,0 +1,142 @@
+package mistral
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/alarbada/sira/sse"
+)
+
+// Usage is the token usage sent with the last chunk of a stream.
+type Usage struct {
+	CompletionTokens int `json:"completion_tokens"`
+	PromptTokens     int `json:"prompt_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// ChatCompletionChunk is a single chunk of a streamed chat completion.
+type ChatCompletionChunk struct {
+	Id      string                      `json:"id"`
+	Object  string                      `json:"object"`
+	Created int                         `json:"created"`
+	Model   string                      `json:"model"`
+	Choices []ChatCompletionChunkChoice `json:"choices"`
+	Usage   *Usage                      `json:"usage,omitempty"`
+}
+
+type ChatCompletionChunkChoice struct {
+	Index int `json:"index"`
+	Delta struct {
+		Role    *string `json:"role,omitempty"`
+		Content string  `json:"content"`
+	} `json:"delta"`
+	// FinishReason is only set on the last chunk of a choice.
+	FinishReason *ChatCompletionResponseChoicesFinishReason `json:"finish_reason,omitempty"`
+}
+
+// StreamError is an error object sent in the middle of a stream.
+type StreamError struct {
+	Object  string `json:"object"`
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    any    `json:"code"`
+}
+
+func (e *StreamError) Error() string {
+	if e.Type != "" {
+		return fmt.Sprintf("mistral stream error (%s): %s", e.Type, e.Message)
+	}
+	return "mistral stream error: " + e.Message
+}
+
+// ChatCompletionStream iterates over the chunks of a streamed chat completion:
+//
+//	stream := NewChatCompletionStream(res.Body)
+//	defer stream.Close()
+//	for stream.Next() {
+//		chunk := stream.Current()
+//	}
+//	if err := stream.Err(); err != nil {
+//	}
+type ChatCompletionStream struct {
+	body    io.ReadCloser
+	decoder *sse.Decoder
+	current *ChatCompletionChunk
+	err     error
+	done    bool
+}
+
+func NewChatCompletionStream(body io.ReadCloser) *ChatCompletionStream {
+	return &ChatCompletionStream{
+		body:    body,
+		decoder: sse.NewDecoder(body),
+	}
+}
+
+// Next advances the stream to the next chunk. It returns false at the end of
+// the stream or on error, see Err.
+func (s *ChatCompletionStream) Next() bool {
+	if s.done {
+		return false
+	}
+
+	for {
+		event, err := s.decoder.Decode()
+		if err != nil {
+			if err != io.EOF {
+				s.err = err
+			}
+			return s.finish()
+		}
+
+		data := strings.TrimSpace(event.Data)
+		if data == "[DONE]" {
+			return s.finish()
+		}
+		if data == "" {
+			continue
+		}
+
+		chunk := new(ChatCompletionChunk)
+		chunkErr := json.Unmarshal([]byte(data), chunk)
+
+		if event.Event == "error" || (chunkErr == nil && chunk.Object == "error") {
+			streamErr := &StreamError{}
+			if err := json.Unmarshal([]byte(data), streamErr); err != nil || streamErr.Message == "" {
+				streamErr.Message = data
+			}
+			s.err = streamErr
+			return s.finish()
+		}
+
+		if chunkErr != nil {
+			s.err = fmt.Errorf("could not decode chunk %q: %w", data, chunkErr)
+			return s.finish()
+		}
+
+		s.current = chunk
+		return true
+	}
+}
+
+func (s *ChatCompletionStream) finish() bool {
+	s.done = true
+	s.current = nil
+	return false
+}
+
+// Current returns the chunk read by the last call to Next.
+func (s *ChatCompletionStream) Current() *ChatCompletionChunk {
+	return s.current
+}
+
+// Err returns the error that stopped the stream, if any.
+func (s *ChatCompletionStream) Err() error {
+	return s.err
+}
+
+func (s *ChatCompletionStream) Close() error {
+	return s.body.Close()
+}
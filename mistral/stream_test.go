@@ -0,0 +1,95 @@
+package mistral
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newStream(input string) *ChatCompletionStream {
+	return NewChatCompletionStream(io.NopCloser(strings.NewReader(input)))
+}
+
+func TestChatCompletionStream(t *testing.T) {
+	t.Run("chunks", func(t *testing.T) {
+		stream := newStream(`data: {"id":"1","object":"chat.completion.chunk","model":"mistral-tiny","choices":[{"index":0,"delta":{"role":"assistant","content":""}}]}
+
+data: {"id":"1","object":"chat.completion.chunk","model":"mistral-tiny","choices":[{"index":0,"delta":{"content":"Hello"}}]}
+
+data: {"id":"1","object":"chat.completion.chunk","model":"mistral-tiny","choices":[{"index":0,"delta":{"content":" world"},"finish_reason":"stop"}],"usage":{"prompt_tokens":7,"completion_tokens":2,"total_tokens":9}}
+
+data: [DONE]
+
+`)
+		defer stream.Close()
+
+		var content string
+		var last *ChatCompletionChunk
+		for stream.Next() {
+			last = stream.Current()
+			content += last.Choices[0].Delta.Content
+		}
+		assert.NoError(t, stream.Err())
+		assert.False(t, stream.Next())
+
+		assert.Equal(t, "Hello world", content)
+		assert.Equal(t, Stop, *last.Choices[0].FinishReason)
+		assert.Equal(t, &Usage{PromptTokens: 7, CompletionTokens: 2, TotalTokens: 9}, last.Usage)
+	})
+
+	t.Run("error object", func(t *testing.T) {
+		stream := newStream(`data: {"choices":[{"index":0,"delta":{"content":"Hel"}}]}
+
+data: {"object":"error","message":"Service unavailable","type":"internal_error","code":"1000"}
+
+`)
+		assert.True(t, stream.Next())
+		assert.False(t, stream.Next())
+
+		var streamErr *StreamError
+		assert.ErrorAs(t, stream.Err(), &streamErr)
+		assert.Equal(t, "Service unavailable", streamErr.Message)
+		assert.Equal(t, "internal_error", streamErr.Type)
+	})
+
+	t.Run("error event", func(t *testing.T) {
+		stream := newStream("event: error\ndata: upstream timed out\n\n")
+		assert.False(t, stream.Next())
+		assert.EqualError(t, stream.Err(), "mistral stream error: upstream timed out")
+	})
+
+	t.Run("invalid json", func(t *testing.T) {
+		stream := newStream("data: {not json\n\n")
+		assert.False(t, stream.Next())
+		assert.Error(t, stream.Err())
+	})
+
+	t.Run("empty choices", func(t *testing.T) {
+		stream := newStream("data: {\"choices\":[]}\n\n")
+		assert.True(t, stream.Next())
+		assert.Empty(t, stream.Current().Choices)
+		assert.False(t, stream.Next())
+		assert.NoError(t, stream.Err())
+	})
+}
+
+func FuzzChatCompletionStream(f *testing.F) {
+	f.Add("data: {\"choices\":[]}\n\ndata: [DONE]\n\n")
+	f.Add("event: error\ndata: a\ndata: b\r\n\r\n: comment\nretry: x\n")
+	f.Add("data")
+	f.Add("\n\n\n:")
+
+	f.Fuzz(func(t *testing.T, input string) {
+		stream := newStream(input)
+		for stream.Next() {
+			if stream.Current() == nil {
+				t.Fatal("Next returned true without a chunk")
+			}
+		}
+		if stream.Current() != nil {
+			t.Fatal("Current returned a chunk after the end of the stream")
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import "strings"
+
+// modelInfo is what sira knows about a model.
+type modelInfo struct {
+	// ContextLength is the size of the context window in tokens, prompt and
+	// answer included.
+	ContextLength int
+	// Pricing is nil when the price of the model is unknown.
+	Pricing *modelPricing
+}
+
+// modelPricing is the price of a model in dollars per million tokens.
+type modelPricing struct {
+	Input  float64
+	Output float64
+}
+
+// Cost returns the price of a request, in dollars.
+func (p *modelPricing) Cost(inputTokens, outputTokens int) float64 {
+	return (float64(inputTokens)*p.Input + float64(outputTokens)*p.Output) / 1e6
+}
+
+// local models cost nothing
+var free = &modelPricing{}
+
+// knownModels maps model names to their info. Names are matched by prefix,
+// the longest wins, so dated versions like gpt-4-0613 match gpt-4. Prices
+// are the public ones of late 2024, and change.
+var knownModels = map[string]modelInfo{
+	// openai
+	"gpt-3.5-turbo":      {ContextLength: 16385, Pricing: &modelPricing{0.5, 1.5}},
+	"gpt-3.5-turbo-0301": {ContextLength: 4096, Pricing: &modelPricing{1.5, 2}},
+	"gpt-3.5-turbo-0613": {ContextLength: 4096, Pricing: &modelPricing{1.5, 2}},
+	"gpt-4":              {ContextLength: 8192, Pricing: &modelPricing{30, 60}},
+	"gpt-4-32k":          {ContextLength: 32768, Pricing: &modelPricing{60, 120}},
+	"gpt-4-0125":         {ContextLength: 128000, Pricing: &modelPricing{10, 30}},
+	"gpt-4-1106":         {ContextLength: 128000, Pricing: &modelPricing{10, 30}},
+	"gpt-4-turbo":        {ContextLength: 128000, Pricing: &modelPricing{10, 30}},
+	"gpt-4o":             {ContextLength: 128000, Pricing: &modelPricing{2.5, 10}},
+	"gpt-4o-mini":        {ContextLength: 128000, Pricing: &modelPricing{0.15, 0.6}},
+
+	// mistral
+	"mistral-tiny":       {ContextLength: 32000, Pricing: &modelPricing{0.25, 0.25}},
+	"mistral-small":      {ContextLength: 32000, Pricing: &modelPricing{0.2, 0.6}},
+	"mistral-medium":     {ContextLength: 32000, Pricing: &modelPricing{2.7, 8.1}},
+	"mistral-large":      {ContextLength: 128000, Pricing: &modelPricing{2, 6}},
+	"open-mistral-7b":    {ContextLength: 32000, Pricing: &modelPricing{0.25, 0.25}},
+	"open-mistral-nemo":  {ContextLength: 128000, Pricing: &modelPricing{0.15, 0.15}},
+	"open-mixtral-8x7b":  {ContextLength: 32000, Pricing: &modelPricing{0.7, 0.7}},
+	"open-mixtral-8x22b": {ContextLength: 64000, Pricing: &modelPricing{2, 6}},
+	"codestral":          {ContextLength: 32000, Pricing: &modelPricing{0.2, 0.6}},
+
+	// anthropic
+	"claude-2":          {ContextLength: 100000, Pricing: &modelPricing{8, 24}},
+	"claude-instant":    {ContextLength: 100000, Pricing: &modelPricing{0.8, 2.4}},
+	"claude-3":          {ContextLength: 200000},
+	"claude-3-haiku":    {ContextLength: 200000, Pricing: &modelPricing{0.25, 1.25}},
+	"claude-3-sonnet":   {ContextLength: 200000, Pricing: &modelPricing{3, 15}},
+	"claude-3-opus":     {ContextLength: 200000, Pricing: &modelPricing{15, 75}},
+	"claude-3-5-haiku":  {ContextLength: 200000, Pricing: &modelPricing{0.8, 4}},
+	"claude-3-5-sonnet": {ContextLength: 200000, Pricing: &modelPricing{3, 15}},
+
+	// gemini, for prompts up to 128k tokens
+	"gemini-pro":       {ContextLength: 32760, Pricing: &modelPricing{0.5, 1.5}},
+	"gemini-1.0-pro":   {ContextLength: 32760, Pricing: &modelPricing{0.5, 1.5}},
+	"gemini-1.5-flash": {ContextLength: 1048576, Pricing: &modelPricing{0.075, 0.3}},
+	"gemini-1.5-pro":   {ContextLength: 2097152, Pricing: &modelPricing{1.25, 5}},
+
+	// ollama defaults
+	"llama2":    {ContextLength: 4096, Pricing: free},
+	"llama3":    {ContextLength: 8192, Pricing: free},
+	"llama3.1":  {ContextLength: 131072, Pricing: free},
+	"mistral":   {ContextLength: 32768, Pricing: free},
+	"mixtral":   {ContextLength: 32768, Pricing: free},
+	"codellama": {ContextLength: 16384, Pricing: free},
+	"gemma":     {ContextLength: 8192, Pricing: free},
+	"phi3":      {ContextLength: 4096, Pricing: free},
+}
+
+// lookupModel returns the info of model, if known.
+func lookupModel(model string) (modelInfo, bool) {
+	var (
+		info    modelInfo
+		longest = -1
+	)
+
+	for name, candidate := range knownModels {
+		if strings.HasPrefix(model, name) && len(name) > longest {
+			info, longest = candidate, len(name)
+		}
+	}
+
+	return info, longest >= 0
+}
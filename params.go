@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/term"
+)
+
+// paramEnvPrefix is the prefix of the environment variables setting template
+// params, like SIRA_PARAM_topic.
+const paramEnvPrefix = "SIRA_PARAM_"
+
+// paramFlags collects the repeated --param flags.
+type paramFlags []string
+
+func (f *paramFlags) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *paramFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// parseParamFlags parses params given as key=value. The value is read from a
+// file with key=@file, and from stdin with key=@-, which only one param can
+// use. A leading @@ stands for a literal @.
+func parseParamFlags(flags []string, stdin io.Reader) (map[string]any, error) {
+	params := make(map[string]any)
+	readStdin := false
+
+	for _, flag := range flags {
+		name, raw, ok := strings.Cut(flag, "=")
+		if !ok || !isValidPath(name) || strings.Contains(name, ".") {
+			return nil, fmt.Errorf("invalid param %q, expected key=value", flag)
+		}
+
+		switch {
+		case raw == "@-":
+			if readStdin {
+				return nil, errors.New("only one param can be read from stdin")
+			}
+			readStdin = true
+
+			contents, err := io.ReadAll(stdin)
+			if err != nil {
+				return nil, fmt.Errorf("param %s: %w", name, err)
+			}
+			params[name] = strings.TrimSuffix(string(contents), "\n")
+
+		case strings.HasPrefix(raw, "@@"):
+			params[name] = raw[1:]
+
+		case strings.HasPrefix(raw, "@"):
+			contents, err := os.ReadFile(raw[1:])
+			if err != nil {
+				return nil, fmt.Errorf("param %s: %w", name, err)
+			}
+			params[name] = strings.TrimSuffix(string(contents), "\n")
+
+		default:
+			params[name] = coerceParam(raw)
+		}
+	}
+
+	return params, nil
+}
+
+// coerceParam parses a value typed by the user as a toml value, like 3, 0.7,
+// true or ["a", "b"], falling back to the text itself.
+func coerceParam(raw string) any {
+	if strings.ContainsAny(raw, "\r\n") {
+		return raw
+	}
+
+	var doc map[string]any
+	if _, err := toml.Decode("v = "+raw, &doc); err != nil || len(doc) != 1 {
+		return raw
+	}
+
+	// "nan" and "inf" are more likely words than numbers
+	if f, ok := doc["v"].(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		return raw
+	}
+
+	return doc["v"]
+}
+
+// templateParams are the params of a template given on the command line,
+// completed with the environment and, in a terminal, by asking the user.
+type templateParams struct {
+	values map[string]any
+	// ask prompts the user for the value of a param. It is nil when sira
+	// does not run in a terminal.
+	ask func(name string) (string, error)
+}
+
+// resolve returns the params to render doc with. A param set with a flag wins
+// over a SIRA_PARAM_<name> environment variable, which wins over defaults.
+// The placeholders still missing are asked for, if possible, and left for
+// the template to report otherwise.
+func (p *templateParams) resolve(doc *Document, defaults map[string]any) (map[string]any, error) {
+	used, required := doc.templateParams()
+
+	params := make(map[string]any)
+	for name, value := range defaults {
+		params[name] = value
+	}
+	for _, name := range used {
+		if value, ok := os.LookupEnv(paramEnvPrefix + name); ok {
+			params[name] = coerceParam(value)
+		}
+	}
+	if p == nil {
+		return params, nil
+	}
+	for name, value := range p.values {
+		params[name] = value
+	}
+
+	if p.ask == nil {
+		return params, nil
+	}
+	for _, name := range required {
+		if _, ok := params[name]; ok {
+			continue
+		}
+
+		value, err := p.ask(name)
+		if err != nil {
+			return nil, fmt.Errorf("param %s: %w", name, err)
+		}
+		params[name] = coerceParam(value)
+	}
+
+	return params, nil
+}
+
+// askParam returns a function asking for params on out and reading the
+// answers from in, one per line.
+func askParam(in io.Reader, out io.Writer) func(string) (string, error) {
+	reader := bufio.NewReader(in)
+
+	return func(name string) (string, error) {
+		fmt.Fprintf(out, "%s: ", name)
+
+		line, err := reader.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+}
+
+// isTerminal reports whether f is a terminal rather than a pipe, a file or
+// another device like /dev/null.
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
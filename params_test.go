@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoerceParam(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected any
+	}{
+		{"rainbows", "rainbows"},
+		{"two words", "two words"},
+		{"3", int64(3)},
+		{"0.7", 0.7},
+		{"true", true},
+		{`"3"`, "3"},
+		{`["a", "b"]`, []any{"a", "b"}},
+		{"nan", "nan"},
+		{"inf", "inf"},
+		{"1\nb = 2", "1\nb = 2"},
+		{"1 # comment", int64(1)},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, coerceParam(tt.raw), tt.raw)
+	}
+}
+
+func TestParseParamFlags(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "code.go")
+	assert.NoError(t, os.WriteFile(file, []byte("package main\n"), 0644))
+
+	params, err := parseParamFlags([]string{
+		"topic=rainbows",
+		"lines=3",
+		"code=@" + file,
+		"input=@-",
+		"handle=@@sira",
+		"empty=",
+	}, strings.NewReader("from stdin\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"topic":  "rainbows",
+		"lines":  int64(3),
+		"code":   "package main",
+		"input":  "from stdin",
+		"handle": "@sira",
+		"empty":  "",
+	}, params)
+
+	_, err = parseParamFlags([]string{"a=@-", "b=@-"}, strings.NewReader(""))
+	assert.EqualError(t, err, "only one param can be read from stdin")
+
+	_, err = parseParamFlags([]string{"topic"}, nil)
+	assert.EqualError(t, err, `invalid param "topic", expected key=value`)
+
+	_, err = parseParamFlags([]string{"code=@missing.go"}, nil)
+	assert.ErrorContains(t, err, "param code: open missing.go")
+}
+
+func TestResolveParams(t *testing.T) {
+	doc := parseDocument(`# system
+Write {lines|3} lines about {topic} for {audience}.
+{if rhyme}Rhyme.{end}
+{for word in words}{word}{end}
+
+# assistant
+{ignored}
+`)
+
+	t.Setenv(paramEnvPrefix+"topic", "rainbows")
+	t.Setenv(paramEnvPrefix+"audience", "kids")
+	t.Setenv(paramEnvPrefix+"unused", "x")
+
+	var asked []string
+	params := &templateParams{
+		values: map[string]any{"audience": "adults"},
+		ask: func(name string) (string, error) {
+			asked = append(asked, name)
+			return `["a", "b"]`, nil
+		},
+	}
+
+	values, err := params.resolve(doc, map[string]any{"topic": "food", "lines": int64(5)})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"topic":    "rainbows",
+		"audience": "adults",
+		"lines":    int64(5),
+		"words":    []any{"a", "b"},
+	}, values)
+	assert.Equal(t, []string{"words"}, asked)
+
+	// without a terminal, missing params are left for the template to report
+	values, err = (*templateParams)(nil).resolve(doc, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]any{"topic": "rainbows", "audience": "kids"}, values)
+}
+
+func TestAskParam(t *testing.T) {
+	var prompts strings.Builder
+	ask := askParam(strings.NewReader("rainbows\r\nkids"), &prompts)
+
+	for _, expected := range []string{"rainbows", "kids"} {
+		value, err := ask("x")
+		assert.NoError(t, err)
+		assert.Equal(t, expected, value)
+	}
+
+	_, err := ask("x")
+	assert.Error(t, err)
+	assert.Equal(t, "x: x: x: ", prompts.String())
+}
+
+func TestIsTerminal(t *testing.T) {
+	devNull, err := os.Open(os.DevNull)
+	assert.NoError(t, err)
+	defer devNull.Close()
+
+	assert.False(t, isTerminal(devNull), "a character device is not a terminal")
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+type TokenKind string
+
+const (
+	TokenKind_System    TokenKind = "# system"
+	TokenKind_Assistant TokenKind = "# assistant"
+	TokenKind_User      TokenKind = "# user"
+	TokenKind_Comment   TokenKind = ">>>"
+
+	// TokenKind_FrontMatter delimits the front matter block, "+++" for toml
+	// and "---" for yaml.
+	TokenKind_FrontMatter TokenKind = "front matter"
+)
+
+var roleTokenKinds = []TokenKind{TokenKind_System, TokenKind_Assistant, TokenKind_User}
+
+func (this TokenKind) ToRole() string {
+	switch this {
+	case TokenKind_System:
+		return "system"
+	case TokenKind_Assistant:
+		return "assistant"
+	case TokenKind_User:
+		return "user"
+	}
+
+	panic("unreachable")
+}
+
+// roleTokenKind is the opposite of ToRole.
+func roleTokenKind(role string) TokenKind {
+	for _, kind := range roleTokenKinds {
+		if kind.ToRole() == role {
+			return kind
+		}
+	}
+
+	panic("unknown role " + role)
+}
+
+// Pos is a position in a conversation file. Line and Column start at 1, and
+// Column counts bytes.
+type Pos struct {
+	Offset int
+	Line   int
+	Column int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Span is the part of a file between Start, included, and End, excluded.
+type Span struct {
+	Start Pos
+	End   Pos
+}
+
+type Token struct {
+	Kind TokenKind
+	// Pos is the byte offset of the token, same as Span.Start.Offset.
+	Pos int
+	// Span covers the whole line of the token, without the line break.
+	Span Span
+	// Attrs are the raw annotations following a role, like
+	// "(pin) {temperature=0.1}" in "# user (pin) {temperature=0.1}".
+	Attrs string
+}
+
+type TokenizerState uint8
+
+const (
+	// TokenizerState_ParseRole is the state before the first role header.
+	TokenizerState_ParseRole TokenizerState = iota
+	// TokenizerState_ParseContent is the state inside the body of a message.
+	TokenizerState_ParseContent
+	// TokenizerState_CodeFence is the state inside a fenced code block, where
+	// role headers and comments are plain content.
+	TokenizerState_CodeFence
+	// TokenizerState_FrontMatter is the state inside the front matter block
+	// at the top of the file.
+	TokenizerState_FrontMatter
+)
+
+// Tokenizer finds the role headers and comments of a conversation. Both are
+// only recognized as whole lines, and never inside fenced code blocks, so an
+// answer containing "# user input" in a python snippet is left alone.
+type Tokenizer struct {
+	State TokenizerState
+
+	// fence is the opening fence of the current code block, like "```", or
+	// the front matter delimiter.
+	fence string
+	// delimiters counts the front matter delimiters seen so far.
+	delimiters int
+}
+
+// Tokenize returns the tokens of src, in order.
+func (t *Tokenizer) Tokenize(src string) []Token {
+	var tokens []Token
+
+	if delimiter, ok := hasFrontMatter(src); ok {
+		t.State = TokenizerState_FrontMatter
+		t.fence = delimiter
+	}
+
+	offset := 0
+	for lineNumber := 1; offset < len(src); lineNumber++ {
+		end := strings.IndexByte(src[offset:], '\n')
+		if end < 0 {
+			end = len(src)
+		} else {
+			end += offset
+		}
+		line := strings.TrimSuffix(src[offset:end], "\r")
+
+		span := Span{
+			Start: Pos{Offset: offset, Line: lineNumber, Column: 1},
+			End:   Pos{Offset: offset + len(line), Line: lineNumber, Column: len(line) + 1},
+		}
+
+		if kind, attrs, ok := t.next(line); ok {
+			tokens = append(tokens, Token{
+				Kind:  kind,
+				Pos:   offset,
+				Span:  span,
+				Attrs: attrs,
+			})
+		}
+
+		offset = end + 1
+	}
+
+	return tokens
+}
+
+// next feeds a line to the tokenizer, and returns the kind of token it is, if
+// any, and the annotations of a role header.
+func (t *Tokenizer) next(line string) (TokenKind, string, bool) {
+	if t.State == TokenizerState_FrontMatter {
+		if strings.TrimRight(line, " \t") != t.fence {
+			return "", "", false
+		}
+		t.delimiters++
+		if t.delimiters == 2 {
+			t.State = TokenizerState_ParseRole
+			t.fence = ""
+		}
+		return TokenKind_FrontMatter, "", true
+	}
+
+	if t.State == TokenizerState_CodeFence {
+		if isClosingFence(line, t.fence) {
+			t.State = TokenizerState_ParseContent
+			t.fence = ""
+		}
+		return "", "", false
+	}
+
+	if fence, ok := openingFence(line); ok {
+		t.State = TokenizerState_CodeFence
+		t.fence = fence
+		return "", "", false
+	}
+
+	if strings.HasPrefix(line, string(TokenKind_Comment)) {
+		return TokenKind_Comment, "", true
+	}
+
+	if kind, attrs, ok := roleHeader(line); ok {
+		t.State = TokenizerState_ParseContent
+		return kind, attrs, true
+	}
+
+	return "", "", false
+}
+
+// roleHeader returns the role of a header line and its annotations.
+func roleHeader(line string) (TokenKind, string, bool) {
+	heading := strings.TrimRight(line, " \t")
+	for _, kind := range roleTokenKinds {
+		attrs, ok := strings.CutPrefix(heading, string(kind))
+		if !ok || !isHeaderAttrs(attrs) {
+			continue
+		}
+		return kind, strings.TrimSpace(attrs), true
+	}
+
+	return "", "", false
+}
+
+// isHeaderAttrs reports whether the text after the role of a header looks
+// like annotations: nothing, or blank space then groups in parentheses or
+// braces. "# user input" stays plain text.
+func isHeaderAttrs(attrs string) bool {
+	if attrs == "" {
+		return true
+	}
+	if attrs[0] != ' ' && attrs[0] != '\t' {
+		return false
+	}
+
+	attrs = strings.TrimSpace(attrs)
+	first, last := attrs[0], attrs[len(attrs)-1]
+	return (first == '(' || first == '{') && (last == ')' || last == '}')
+}
+
+// MessageAttrs are the annotations of a role header, like
+// "# user (pin) {temperature=0.1}".
+type MessageAttrs struct {
+	// Pin keeps the message when the context window is truncated.
+	Pin bool
+	// Skip leaves the message out of requests.
+	Skip bool
+	// Overrides are settings applied to the request answering the message,
+	// written as a toml inline table.
+	Overrides map[string]any
+}
+
+// parseHeaderAttrs parses the annotations of a header. Errors are reported
+// at the offset of the problem in attrs.
+func parseHeaderAttrs(attrs string) (MessageAttrs, *TemplateError) {
+	var parsed MessageAttrs
+
+	for i := 0; i < len(attrs); {
+		switch attrs[i] {
+		case ' ', '\t':
+			i++
+
+		case '(':
+			end := strings.IndexByte(attrs[i:], ')')
+			if end < 0 {
+				return parsed, templateErrorAt(i, "unclosed annotation")
+			}
+			for _, flag := range strings.Split(attrs[i+1:i+end], ",") {
+				switch strings.TrimSpace(flag) {
+				case "pin":
+					parsed.Pin = true
+				case "skip":
+					parsed.Skip = true
+				default:
+					return parsed, templateErrorAt(i, "unknown annotation %q, expected pin or skip", strings.TrimSpace(flag))
+				}
+			}
+			i += end + 1
+
+		case '{':
+			if parsed.Overrides != nil {
+				return parsed, templateErrorAt(i, "overrides given twice")
+			}
+			// the table ends at the first closing brace making it valid toml
+			for end := i + 1; end < len(attrs); end++ {
+				if attrs[end] != '}' {
+					continue
+				}
+				var doc map[string]any
+				if _, err := toml.Decode("v = "+attrs[i:end+1], &doc); err == nil {
+					parsed.Overrides, _ = doc["v"].(map[string]any)
+					i = end + 1
+					break
+				}
+			}
+			if parsed.Overrides == nil {
+				return parsed, templateErrorAt(i, "invalid overrides %s, expected a toml inline table like {temperature = 0.1}", attrs[i:])
+			}
+
+		default:
+			return parsed, templateErrorAt(i, "unexpected %q in header, expected (pin), (skip) or {overrides}", attrs[i:])
+		}
+	}
+
+	if parsed.Pin && parsed.Skip {
+		return parsed, templateErrorAt(0, "a message can't be both pinned and skipped")
+	}
+
+	return parsed, nil
+}
+
+// openingFence returns the fence opening a code block on line, following
+// commonmark: up to 3 spaces of indentation, then at least 3 backticks or
+// tildes.
+func openingFence(line string) (string, bool) {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 || len(trimmed) < 3 {
+		return "", false
+	}
+
+	char := trimmed[0]
+	if char != '`' && char != '~' {
+		return "", false
+	}
+
+	n := 0
+	for n < len(trimmed) && trimmed[n] == char {
+		n++
+	}
+	if n < 3 {
+		return "", false
+	}
+	if char == '`' && strings.ContainsRune(trimmed[n:], '`') {
+		return "", false
+	}
+
+	return trimmed[:n], true
+}
+
+// isClosingFence reports whether line closes a code block opened with fence.
+func isClosingFence(line, fence string) bool {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 {
+		return false
+	}
+
+	closing, ok := openingFence(trimmed)
+	if !ok || closing[0] != fence[0] || len(closing) < len(fence) {
+		return false
+	}
+
+	return strings.TrimSpace(trimmed[len(closing):]) == ""
+}
+
+// hasFrontMatter reports whether src starts with a front matter block, and
+// returns its delimiter. The block is closed before the first role header and
+// code fence, so a "---" rule at the top of a conversation doesn't swallow
+// the messages up to the next one. A yaml block must also be a mapping, the
+// text between two rules is not.
+func hasFrontMatter(src string) (string, bool) {
+	lines := strings.Split(src, "\n")
+	delimiter := strings.TrimRight(lines[0], " \t\r")
+	if delimiter != frontMatterTOML && delimiter != frontMatterYAML {
+		return "", false
+	}
+
+	for i, line := range lines[1:] {
+		line = strings.TrimSuffix(line, "\r")
+		if _, _, ok := roleHeader(line); ok {
+			return "", false
+		}
+		if _, ok := openingFence(line); ok {
+			return "", false
+		}
+		if strings.TrimRight(line, " \t") != delimiter {
+			continue
+		}
+
+		if delimiter == frontMatterYAML && !isYAMLMapping(strings.Join(lines[1:i+1], "\n")) {
+			return "", false
+		}
+		return delimiter, true
+	}
+
+	return "", false
+}
+
+// isYAMLMapping reports whether src is a yaml mapping, or empty.
+func isYAMLMapping(src string) bool {
+	var value any
+	if err := yaml.Unmarshal([]byte(src), &value); err != nil {
+		return false
+	}
+	_, ok := value.(map[string]any)
+	return ok || value == nil
+}
+
+func tokenize(rawTemplate string) []Token {
+	var tokenizer Tokenizer
+	return tokenizer.Tokenize(rawTemplate)
+}
+
+const (
+	frontMatterTOML = "+++"
+	frontMatterYAML = "---"
+)
+
+// Document is the syntax tree of a conversation file.
+type Document struct {
+	FrontMatter *FrontMatterNode
+	Messages    []*MessageNode
+	Comments    []Span
+}
+
+// FrontMatterNode is the optional block of settings at the top of a file,
+// delimited by "+++" lines for toml or "---" lines for yaml.
+type FrontMatterNode struct {
+	// Format is either "toml" or "yaml".
+	Format string
+	// Raw is the text between the delimiters.
+	Raw  string
+	Span Span
+}
+
+// MessageNode is a single message of a conversation.
+type MessageNode struct {
+	Role string
+	// Header is the span of the role header line.
+	Header Span
+	// Body is the span of everything between the header and the next one.
+	Body Span
+	// Content is the text of the body without comments, trimmed.
+	Content string
+	// Parts are the spans of the body Content is made of, in order, comment
+	// lines excluded.
+	Parts []Span
+	// Attrs are the annotations of the header.
+	Attrs MessageAttrs
+	// AttrsErr is set when the annotations are invalid, positioned in the
+	// file.
+	AttrsErr *TemplateError
+}
+
+// parseDocument parses a conversation. Text before the first role header is
+// ignored.
+func parseDocument(src string) *Document {
+	doc := new(Document)
+	tokens := tokenize(src)
+
+	var current *MessageNode
+	var content strings.Builder
+	var bodyStart int
+
+	addPart := func(end int) {
+		content.WriteString(src[bodyStart:end])
+		current.Parts = append(current.Parts, Span{Start: posAt(src, bodyStart), End: posAt(src, end)})
+	}
+
+	flush := func(end Token) {
+		if current == nil {
+			return
+		}
+		addPart(end.Span.Start.Offset)
+		current.Body.End = end.Span.Start
+		current.Content = strings.TrimSpace(content.String())
+		content.Reset()
+	}
+
+	for i, token := range tokens {
+		if token.Kind == TokenKind_FrontMatter {
+			// delimiters come in pairs, at the very top of the file
+			if i != 1 {
+				continue
+			}
+			opening := tokens[0]
+
+			format := "toml"
+			if strings.HasPrefix(src, frontMatterYAML) {
+				format = "yaml"
+			}
+			doc.FrontMatter = &FrontMatterNode{
+				Format: format,
+				Raw:    src[skipLine(src, opening.Span.End.Offset):token.Span.Start.Offset],
+				Span:   Span{Start: opening.Span.Start, End: token.Span.End},
+			}
+			continue
+		}
+
+		if token.Kind == TokenKind_Comment {
+			doc.Comments = append(doc.Comments, token.Span)
+			if current != nil {
+				addPart(token.Span.Start.Offset)
+				bodyStart = skipLine(src, token.Span.End.Offset)
+			}
+			continue
+		}
+
+		flush(token)
+
+		bodyStart = skipLine(src, token.Span.End.Offset)
+		current = &MessageNode{
+			Role:   token.Kind.ToRole(),
+			Header: token.Span,
+			Body: Span{
+				Start: Pos{Offset: bodyStart, Line: token.Span.Start.Line + 1, Column: 1},
+			},
+		}
+		if token.Attrs != "" {
+			offset := token.Span.Start.Offset + strings.Index(src[token.Span.Start.Offset:token.Span.End.Offset], token.Attrs)
+			var err *TemplateError
+			if current.Attrs, err = parseHeaderAttrs(token.Attrs); err != nil {
+				err.Pos = posAt(src, offset+err.Pos.Offset)
+				current.AttrsErr = err
+			}
+		}
+		doc.Messages = append(doc.Messages, current)
+	}
+
+	flush(Token{Span: Span{Start: endPos(src)}})
+
+	return doc
+}
+
+// headerAttrs returns the annotations of the header of message, with a
+// leading space, or nothing.
+func (message Message) headerAttrs() string {
+	var attrs string
+	if message.Pinned {
+		attrs += " (pin)"
+	}
+	if message.Overrides != nil {
+		attrs += " " + formatInlineTable(message.Overrides)
+	}
+	return attrs
+}
+
+// formatInlineTable writes table as a toml inline table, keys sorted.
+func formatInlineTable(table map[string]any) string {
+	keys := make([]string, 0, len(table))
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fields := make([]string, len(keys))
+	for i, key := range keys {
+		fields[i] = formatTOMLKey(key) + " = " + formatTOMLValue(table[key])
+	}
+
+	return "{" + strings.Join(fields, ", ") + "}"
+}
+
+// formatTOMLValue writes value as an inline toml value, tables and arrays of
+// tables included.
+func formatTOMLValue(value any) string {
+	if table, ok := value.(map[string]any); ok {
+		return formatInlineTable(table)
+	}
+
+	if v := reflect.ValueOf(value); v.Kind() == reflect.Slice {
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = formatTOMLValue(v.Index(i).Interface())
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+
+	var encoded strings.Builder
+	if err := toml.NewEncoder(&encoded).Encode(map[string]any{"v": value}); err != nil {
+		return strconv.Quote(fmt.Sprint(value))
+	}
+	return strings.TrimSpace(strings.TrimPrefix(encoded.String(), "v = "))
+}
+
+// formatTOMLKey quotes key when it isn't a bare key.
+func formatTOMLKey(key string) string {
+	if isBareKey(key) {
+		return key
+	}
+	return strconv.Quote(key)
+}
+
+func isBareKey(key string) bool {
+	for _, r := range key {
+		if !(r == '_' || r == '-' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return key != ""
+}
+
+// lastTurn returns the last message sent, the one triggering the request, or
+// nil when every message is skipped.
+func (doc *Document) lastTurn() *MessageNode {
+	for i := len(doc.Messages) - 1; i >= 0; i-- {
+		if !doc.Messages[i].Attrs.Skip {
+			return doc.Messages[i]
+		}
+	}
+	return nil
+}
+
+// contentPos returns the position in src of the byte at offset in Content.
+func (node *MessageNode) contentPos(src string, offset int) Pos {
+	var raw strings.Builder
+	for _, part := range node.Parts {
+		raw.WriteString(src[part.Start.Offset:part.End.Offset])
+	}
+	offset += raw.Len() - len(strings.TrimLeftFunc(raw.String(), unicode.IsSpace))
+
+	for _, part := range node.Parts {
+		length := part.End.Offset - part.Start.Offset
+		if offset < length {
+			return posAt(src, part.Start.Offset+offset)
+		}
+		offset -= length
+	}
+
+	return node.Body.End
+}
+
+// skipLine returns the offset of the line after the one ending at offset.
+func skipLine(src string, offset int) int {
+	if offset < len(src) && src[offset] == '\r' {
+		offset++
+	}
+	if offset < len(src) && src[offset] == '\n' {
+		offset++
+	}
+	return offset
+}
+
+// posAt returns the position of the byte at offset in src.
+func posAt(src string, offset int) Pos {
+	before := src[:offset]
+	line := strings.Count(before, "\n") + 1
+	column := offset - strings.LastIndexByte(before, '\n')
+
+	return Pos{Offset: offset, Line: line, Column: column}
+}
+
+// endPos returns the position right after the last byte of src.
+func endPos(src string) Pos {
+	return posAt(src, len(src))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenize(t *testing.T) {
+	src := "# system\nBe brief. # user is not a header\n\n# users\n## user\n # user\n>>> a comment\n# user  \nhi\n"
+	tokens := tokenize(src)
+
+	assert.Equal(t, []Token{
+		{
+			Kind: TokenKind_System,
+			Pos:  0,
+			Span: Span{Start: Pos{Offset: 0, Line: 1, Column: 1}, End: Pos{Offset: 8, Line: 1, Column: 9}},
+		},
+		{
+			Kind: TokenKind_Comment,
+			Pos:  67,
+			Span: Span{Start: Pos{Offset: 67, Line: 7, Column: 1}, End: Pos{Offset: 80, Line: 7, Column: 14}},
+		},
+		{
+			Kind: TokenKind_User,
+			Pos:  81,
+			Span: Span{Start: Pos{Offset: 81, Line: 8, Column: 1}, End: Pos{Offset: 89, Line: 8, Column: 9}},
+		},
+	}, tokens)
+}
+
+func TestParseDocumentCodeFences(t *testing.T) {
+	src := "# user\nwrite a python script\n\n# assistant\nSure:\n\n```python\n# user input\nname = input()\n\n# user\n>>> not a comment\n```\n\n~~~~\n# system\n```\n~~~~\n\n# user\nthanks\n"
+	doc := parseDocument(src)
+
+	if assert.Len(t, doc.Messages, 3) {
+		assert.Equal(t, "user", doc.Messages[0].Role)
+		assert.Equal(t, "write a python script", doc.Messages[0].Content)
+
+		assert.Equal(t, "assistant", doc.Messages[1].Role)
+		assert.Equal(t, "Sure:\n\n```python\n# user input\nname = input()\n\n# user\n>>> not a comment\n```\n\n~~~~\n# system\n```\n~~~~", doc.Messages[1].Content)
+
+		assert.Equal(t, "user", doc.Messages[2].Role)
+		assert.Equal(t, "thanks", doc.Messages[2].Content)
+		assert.Equal(t, Pos{Offset: 142, Line: 20, Column: 1}, doc.Messages[2].Header.Start)
+		assert.Equal(t, Span{
+			Start: Pos{Offset: 149, Line: 21, Column: 1},
+			End:   Pos{Offset: 156, Line: 22, Column: 1},
+		}, doc.Messages[2].Body)
+	}
+
+	assert.Empty(t, doc.Comments)
+}
+
+func TestParseDocumentComments(t *testing.T) {
+	src := ">>> notes\r\n# system\r\nWrite a haiku.\r\n>>> about food\r\nKeep it short.\r\n"
+	doc := parseDocument(src)
+
+	assert.Len(t, doc.Comments, 2)
+	assert.Equal(t, 4, doc.Comments[1].Start.Line)
+	if assert.Len(t, doc.Messages, 1) {
+		assert.Equal(t, "Write a haiku.\r\nKeep it short.", doc.Messages[0].Content)
+	}
+}
+
+func TestOpeningFence(t *testing.T) {
+	for line, expected := range map[string]string{
+		"```":         "```",
+		"```go":       "```go"[:3],
+		"   ~~~~":     "~~~~",
+		"    ```":     "",
+		"``":          "",
+		"``` a ` b":   "",
+		"~~~ a ` b":   "~~~",
+		"# assistant": "",
+	} {
+		fence, ok := openingFence(line)
+		assert.Equal(t, expected != "", ok, line)
+		assert.Equal(t, expected, fence, line)
+	}
+}
+
+func TestParseHeaderAttrs(t *testing.T) {
+	src := "# system (pin)\nsys\n# user {temperature = 0.1, options = {num_predict = 10}}\nu1\n# assistant\t(skip)\na1\n# user (pin) {stop = [\"}\"]}\nu2\n# user input\n"
+	doc := parseDocument(src)
+
+	if assert.Len(t, doc.Messages, 4) {
+		assert.Equal(t, MessageAttrs{Pin: true}, doc.Messages[0].Attrs)
+		assert.Equal(t, MessageAttrs{Overrides: map[string]any{
+			"temperature": 0.1,
+			"options":     map[string]any{"num_predict": int64(10)},
+		}}, doc.Messages[1].Attrs)
+		assert.Equal(t, MessageAttrs{Skip: true}, doc.Messages[2].Attrs)
+		assert.Equal(t, MessageAttrs{Pin: true, Overrides: map[string]any{"stop": []any{"}"}}}, doc.Messages[3].Attrs)
+		assert.Equal(t, "u2\n# user input", doc.Messages[3].Content)
+
+		assert.Same(t, doc.Messages[3], doc.lastTurn())
+	}
+
+	for attrs, expected := range map[string]string{
+		"(pinned)":          `1:8: unknown annotation "pinned", expected pin or skip`,
+		"(pin, skip)":       "1:8: a message can't be both pinned and skipped",
+		"(pin) {x = }":      "1:14: invalid overrides {x = }, expected a toml inline table like {temperature = 0.1}",
+		"{a = 1} {b = 2}":   "1:16: overrides given twice",
+		"(pin) extra (pin)": `1:14: unexpected "extra (pin)" in header, expected (pin), (skip) or {overrides}`,
+		"(pin":              "",
+	} {
+		doc := parseDocument("# user " + attrs + "\nhi\n")
+		if expected == "" {
+			assert.Empty(t, doc.Messages, attrs)
+			continue
+		}
+		if assert.Len(t, doc.Messages, 1, attrs) && assert.NotNil(t, doc.Messages[0].AttrsErr, attrs) {
+			assert.Equal(t, expected, doc.Messages[0].AttrsErr.Error(), attrs)
+		}
+	}
+}
+
+func TestMessageHeaderAttrs(t *testing.T) {
+	message := Message{Role: "user", Pinned: true, Overrides: map[string]any{
+		"temperature": 0.1,
+		"stop":        []any{"}"},
+		"options":     map[string]any{"num_predict": int64(10)},
+		"x.y":         true,
+	}}
+	attrs := message.headerAttrs()
+	assert.Equal(t, ` (pin) {options = {num_predict = 10}, stop = ["}"], temperature = 0.1, "x.y" = true}`, attrs)
+
+	doc := parseDocument("# user" + attrs + "\nhi\n")
+	if assert.Len(t, doc.Messages, 1) {
+		assert.Nil(t, doc.Messages[0].AttrsErr)
+		assert.Equal(t, MessageAttrs{Pin: true, Overrides: message.Overrides}, doc.Messages[0].Attrs)
+	}
+}
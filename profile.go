@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// profilesSection is the table holding the profiles, named setups switched
+// as a whole:
+//
+//	default_profile = "smart"
+//
+//	[profiles.fast]
+//	provider = "groq"
+//	model = "llama3-8b-8192"
+//	temperature = 0.2
+//
+//	[profiles.smart]
+//	provider = "anthropic"
+//	model = "sonnet"
+//	aliases = { sonnet = "claude-3-5-sonnet-latest", haiku = "claude-3-5-haiku-latest" }
+//
+// A profile holds the same settings as a front matter, and model aliases
+// resolved once every override is applied, so --model haiku works too.
+const profilesSection = "profiles"
+
+// profileNames returns the names of the configured profiles, sorted.
+func (file *configFile) profileNames() []string {
+	var names []string
+	for name, value := range file.Section(profilesSection) {
+		if _, ok := value.(map[string]any); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// selectProfile returns the profile selected by the "profile" key of the
+// layers of overrides, the last one winning, or the default profile.
+func (file *configFile) selectProfile(layers ...map[string]any) (string, error) {
+	name := file.DefaultProfile
+	for _, overrides := range layers {
+		value, ok := overrides["profile"]
+		if !ok {
+			continue
+		}
+
+		profile, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("profile must be a string, got %T", value)
+		}
+		name = profile
+	}
+
+	return name, nil
+}
+
+// withProfile returns a copy of the config with the settings of the named
+// profile applied, or the config itself when name is empty.
+func (file *configFile) withProfile(name string) (*configFile, error) {
+	if name == "" {
+		return file, nil
+	}
+
+	profile, ok := file.Section(profilesSection)[name].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q, available profiles: %v", name, file.profileNames())
+	}
+
+	overrides := make(map[string]any, len(profile))
+	for key, value := range profile {
+		if key != "aliases" && key != "profile" {
+			overrides[key] = value
+		}
+	}
+
+	merged, err := file.withOverrides(overrides)
+	if err != nil {
+		return nil, fmt.Errorf("profile %q: %w", name, err)
+	}
+	if merged == file {
+		copied := *file
+		merged = &copied
+	}
+	merged.profile = name
+
+	selected, err := merged.selectedProvider()
+	if err != nil {
+		return nil, fmt.Errorf("profile %q: %w", name, err)
+	}
+
+	merged.origins = make(map[string]string, len(file.origins))
+	for path, origin := range file.origins {
+		merged.origins[path] = origin
+	}
+	for key, value := range overrides {
+		if key == "provider" {
+			merged.origins[key] = "profile " + name
+			continue
+		}
+		if table, ok := value.(map[string]any); ok && merged.isSectionName(key) {
+			walkSettings(table, key+".", func(path string) {
+				merged.origins[path] = "profile " + name
+			})
+			continue
+		}
+		merged.origins[selected+"."+key] = "profile " + name
+	}
+
+	return merged, nil
+}
+
+// modelAliases returns the model aliases of the active profile.
+func (file *configFile) modelAliases() (map[string]string, error) {
+	if file.profile == "" {
+		return nil, nil
+	}
+
+	profile, _ := file.Section(profilesSection)[file.profile].(map[string]any)
+	value, ok := profile["aliases"]
+	if !ok {
+		return nil, nil
+	}
+
+	table, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("profile %q: aliases must be a table, got %T", file.profile, value)
+	}
+
+	aliases := make(map[string]string, len(table))
+	for alias, model := range table {
+		name, ok := model.(string)
+		if !ok {
+			return nil, fmt.Errorf("profile %q: alias %q must name a model, got %T", file.profile, alias, model)
+		}
+		aliases[alias] = name
+	}
+
+	return aliases, nil
+}
+
+// withModelAlias returns the config with the model of the selected provider
+// replaced when it is an alias of the active profile.
+func (file *configFile) withModelAlias() (*configFile, error) {
+	aliases, err := file.modelAliases()
+	if err != nil || len(aliases) == 0 {
+		return file, err
+	}
+
+	selected, err := file.selectedProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	model, _ := file.Section(selected)["model"].(string)
+	resolved, ok := aliases[model]
+	if !ok {
+		return file, nil
+	}
+	verboseLog.Printf("model %s is an alias of %s", model, resolved)
+
+	return file.withOverrides(map[string]any{selected: map[string]any{"model": resolved}})
+}
+
+// withFlags returns the config with the profile and the command line flags
+// applied, for the commands that don't read a conversation.
+func (file *configFile) withFlags() (*configFile, error) {
+	name, err := file.selectProfile(file.flags)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := file.withProfile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err = config.withOverrides(file.flags)
+	if err != nil {
+		return nil, err
+	}
+
+	return config.withModelAlias()
+}
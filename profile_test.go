@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProfiles(t *testing.T) {
+	config, err := parseConfig(`
+provider = "openai"
+default_profile = "smart"
+
+[openai]
+model = "gpt-3.5-turbo"
+temperature = 0.7
+
+[ollama]
+model = "llama2"
+
+[profiles.smart]
+model = "big"
+aliases = { big = "gpt-4o", small = "gpt-4o-mini" }
+
+[profiles.local]
+provider = "ollama"
+model = "llama3"
+options = { temperature = 0.1 }
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"local", "smart"}, config.profileNames())
+
+	smart, err := config.withFlags()
+	assert.NoError(t, err)
+	assert.Equal(t, "gpt-4o", smart.Section("openai")["model"])
+	assert.Equal(t, 0.7, smart.Section("openai")["temperature"])
+	assert.Equal(t, "profile smart", smart.origins["openai.model"])
+
+	config.flags = map[string]any{"model": "small"}
+	small, err := config.withFlags()
+	assert.NoError(t, err)
+	assert.Equal(t, "gpt-4o-mini", small.Section("openai")["model"])
+
+	config.flags = map[string]any{"profile": "local"}
+	local, err := config.withFlags()
+	assert.NoError(t, err)
+	assert.Equal(t, "ollama", local.Provider)
+	assert.Equal(t, "llama3", local.Section("ollama")["model"])
+	assert.Equal(t, map[string]any{"temperature": 0.1}, local.Section("ollama")["options"])
+	assert.Equal(t, "gpt-3.5-turbo", local.Section("openai")["model"])
+
+	config.flags = map[string]any{"profile": "fast"}
+	_, err = config.withFlags()
+	assert.EqualError(t, err, `unknown profile "fast", available profiles: [local smart]`)
+
+	config.flags = map[string]any{"profile": 1}
+	_, err = config.withFlags()
+	assert.EqualError(t, err, `profile must be a string, got int`)
+
+	// the original config is left untouched
+	assert.Equal(t, "openai", config.Provider)
+	assert.Equal(t, "gpt-3.5-turbo", config.Section("openai")["model"])
+}
+
+func TestCLIChatProfile(t *testing.T) {
+	config, received := newOllamaConfig(t)
+	contents, err := os.ReadFile(config)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(config, append(contents, []byte(`
+[profiles.creative]
+provider = "ollama"
+model = "writer"
+aliases = { writer = "llama3:70b", coder = "codellama" }
+
+[profiles.strict]
+provider = "ollama"
+options = { temperature = 0.0 }
+`)...), 0600))
+
+	filename := filepath.Join(t.TempDir(), "chat.md")
+	assert.NoError(t, os.WriteFile(filename, []byte("+++\nprofile = 'creative'\n+++\n# user\nhi\n"), 0644))
+
+	code, _, stderr := runSira(t, "", "--config", config, filename)
+	assert.Equal(t, exitOK, code, stderr)
+
+	code, _, stderr = runSira(t, "", "--config", config, filename, "--model", "coder")
+	assert.Equal(t, exitOK, code, stderr)
+
+	code, _, stderr = runSira(t, "", "--config", config, filename, "--profile", "strict")
+	assert.Equal(t, exitOK, code, stderr)
+
+	if assert.Len(t, *received, 3) {
+		assert.Equal(t, "llama3:70b", (*received)[0].Model)
+		assert.Equal(t, "codellama", (*received)[1].Model)
+		assert.Equal(t, "llama2", (*received)[2].Model)
+		assert.Equal(t, 0.0, (*received)[2].Options["temperature"])
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// Message is a provider neutral chat message, as parsed from a conversation
+// file.
+type Message struct {
+	Role    string
+	Content string
+	// Pinned messages are never dropped from the context window.
+	Pinned bool
+	// Overrides are the settings overridden by the message, for the request
+	// it triggers.
+	Overrides map[string]any
+}
+
+// Usage is the token accounting reported by a provider for a single request.
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+}
+
+func (u Usage) TotalTokens() int {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+// Completion is the result of a streamed chat completion.
+type Completion struct {
+	Message      Message
+	FinishReason string
+	Usage        Usage
+}
+
+// Provider is implemented by every llm backend sira can talk to.
+type Provider interface {
+	// ChatStream sends the conversation to the model, calling onDelta for
+	// every chunk of streamed content, and returns the full assistant message.
+	ChatStream(ctx context.Context, messages []Message, onDelta func(string)) (*Completion, error)
+
+	// ListModels returns the ids of the models available to the user.
+	ListModels(ctx context.Context) ([]string, error)
+}
+
+// providerFactory builds a provider from the user configuration. section is
+// the name of the config table holding the provider settings, which is the
+// provider name itself unless the table declares its type explicitly.
+type providerFactory func(config *configFile, section string) (Provider, error)
+
+var providers = map[string]providerFactory{}
+
+// registerProvider makes a provider selectable by name from the config file.
+// It is meant to be called from the init function of each provider file.
+func registerProvider(name string, factory providerFactory) {
+	if _, ok := providers[name]; ok {
+		panic("provider registered twice: " + name)
+	}
+
+	providers[name] = factory
+}
+
+// providerNames returns the registered provider names, sorted.
+func providerNames() []string {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// legacyProviderOrder is the order in which providers were picked before the
+// "provider" key existed, when more than one section was configured.
+var legacyProviderOrder = []string{"openai", "mistral"}
+
+// providerType returns the registered provider implementing the given name.
+// A name is either a registered provider, or a config section with a "type"
+// key naming one, e.g. an openai compatible server:
+//
+//	[llamacpp]
+//	type = "openai"
+//	base_url = "http://localhost:8080/v1"
+func (file *configFile) providerType(name string) (string, bool) {
+	if section := file.Section(name); section != nil {
+		if kind, ok := section["type"].(string); ok {
+			_, registered := providers[kind]
+			return kind, registered
+		}
+	}
+
+	_, registered := providers[name]
+	return name, registered
+}
+
+// selectedProvider returns the name of the provider to use. The top level
+// "provider" key wins, otherwise the first configured provider section is
+// used.
+func (file *configFile) selectedProvider() (string, error) {
+	if file.Provider != "" {
+		if _, ok := file.providerType(file.Provider); !ok {
+			return "", fmt.Errorf("Unknown provider %q, available providers: %v", file.Provider, providerNames())
+		}
+		return file.Provider, nil
+	}
+
+	candidates := append([]string{}, legacyProviderOrder...)
+	candidates = append(candidates, providerNames()...)
+	for _, name := range candidates {
+		if _, ok := providers[name]; !ok {
+			continue
+		}
+		if file.Section(name) != nil {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("No provider configured, add one of %v sections", providerNames())
+}
+
+func newProvider(config *configFile) (Provider, error) {
+	name, err := config.selectedProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	kind, _ := config.providerType(name)
+	return providers[kind](config, name)
+}
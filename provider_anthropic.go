@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/alarbada/sira/sse"
+)
+
+func init() {
+	registerProvider("anthropic", newAnthropicProvider)
+	registerProviderSchema("anthropic", "json", anthropicConfig{}, generationParams{})
+}
+
+const (
+	anthropicDefaultBaseURL   = "https://api.anthropic.com"
+	anthropicDefaultVersion   = "2023-06-01"
+	anthropicDefaultMaxTokens = 1024
+)
+
+// anthropicConfig is the [anthropic] section of the config file.
+type anthropicConfig struct {
+	Apikey        string   `json:"apikey"`
+	ApikeyCmd     string   `json:"apikey_cmd"`
+	BaseURL       string   `json:"base_url"`
+	Version       string   `json:"version"`
+	Model         string   `json:"model"`
+	MaxTokens     int      `json:"max_tokens"`
+	Temperature   *float64 `json:"temperature"`
+	TopP          *float64 `json:"top_p"`
+	TopK          *int     `json:"top_k"`
+	StopSequences []string `json:"stop_sequences"`
+}
+
+type anthropicProvider struct {
+	httpClient *http.Client
+	apiKey     string
+	config     anthropicConfig
+}
+
+func newAnthropicProvider(config *configFile, section string) (Provider, error) {
+	parsedConfig := anthropicConfig{}
+	if err := decodeSection(config.Section(section), &parsedConfig); err != nil {
+		return nil, err
+	}
+
+	if parsedConfig.Model == "" {
+		return nil, fmt.Errorf("anthropic: model is required")
+	}
+	if parsedConfig.BaseURL == "" {
+		parsedConfig.BaseURL = anthropicDefaultBaseURL
+	}
+	parsedConfig.BaseURL = strings.TrimSuffix(parsedConfig.BaseURL, "/")
+	if parsedConfig.Version == "" {
+		parsedConfig.Version = anthropicDefaultVersion
+	}
+	if parsedConfig.MaxTokens == 0 {
+		parsedConfig.MaxTokens = anthropicDefaultMaxTokens
+	}
+
+	params, err := decodeGenerationParams(config.Section(section))
+	if err != nil {
+		return nil, err
+	}
+	parsedConfig.Temperature = params.Temperature
+	if parsedConfig.StopSequences == nil {
+		parsedConfig.StopSequences = params.Stop
+	}
+	if params.Seed != nil {
+		verboseLog.Printf("anthropic: seed is not supported by the api, ignored")
+	}
+
+	apiKey, err := config.apiKey(section, parsedConfig.Apikey, parsedConfig.ApikeyCmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return &anthropicProvider{
+		httpClient: config.newHTTPClient(),
+		apiKey:     apiKey,
+		config:     parsedConfig,
+	}, nil
+}
+
+type anthropicMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type anthropicRequest struct {
+	Model         string             `json:"model"`
+	System        string             `json:"system,omitempty"`
+	Messages      []anthropicMessage `json:"messages"`
+	MaxTokens     int                `json:"max_tokens"`
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	TopK          *int               `json:"top_k,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Stream        bool               `json:"stream"`
+}
+
+// toAnthropicMessages converts sira messages to the Messages API shape: system
+// messages go to the top level system prompt, empty messages are dropped and
+// consecutive messages of the same role are merged, as the API requires
+// strict user/assistant alternation starting with a user turn.
+func toAnthropicMessages(messages []Message) (string, []anthropicMessage, error) {
+	var (
+		system    []string
+		converted []anthropicMessage
+	)
+
+	for _, msg := range messages {
+		if msg.Content == "" {
+			continue
+		}
+
+		if msg.Role == "system" {
+			system = append(system, msg.Content)
+			continue
+		}
+
+		last := len(converted) - 1
+		if last >= 0 && converted[last].Role == msg.Role {
+			converted[last].Content += "\n\n" + msg.Content
+			continue
+		}
+
+		converted = append(converted, anthropicMessage{
+			Role:    msg.Role,
+			Content: msg.Content,
+		})
+	}
+
+	if len(converted) == 0 {
+		return "", nil, errors.New("anthropic: the conversation has no user message")
+	}
+	if converted[0].Role != "user" {
+		return "", nil, errors.New("anthropic: the conversation must start with a user message")
+	}
+
+	return strings.Join(system, "\n\n"), converted, nil
+}
+
+// anthropicStreamEvent holds the fields of every streamed event type sira
+// cares about.
+type anthropicStreamEvent struct {
+	Type    string `json:"type"`
+	Message struct {
+		Usage struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	} `json:"message"`
+	Delta struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage struct {
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *anthropicProvider) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, p.config.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("x-api-key", p.apiKey)
+	req.Header.Set("anthropic-version", p.config.Version)
+	req.Header.Set("Content-Type", "application/json")
+
+	return req, nil
+}
+
+func (p *anthropicProvider) ChatStream(ctx context.Context, messages []Message, onDelta func(string)) (*Completion, error) {
+	system, converted, err := toAnthropicMessages(messages)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(anthropicRequest{
+		Model:         p.config.Model,
+		System:        system,
+		Messages:      converted,
+		MaxTokens:     p.config.MaxTokens,
+		Temperature:   p.config.Temperature,
+		TopP:          p.config.TopP,
+		TopK:          p.config.TopK,
+		StopSequences: p.config.StopSequences,
+		Stream:        true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := p.newRequest(ctx, "POST", "/v1/messages", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, newAPIError("anthropic", res)
+	}
+
+	completion := new(Completion)
+	completion.Message.Role = "assistant"
+
+	decoder := sse.NewDecoder(res.Body)
+	for {
+		event, err := decoder.Decode()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		var data anthropicStreamEvent
+		if err := json.Unmarshal([]byte(event.Data), &data); err != nil {
+			return nil, fmt.Errorf("anthropic: could not decode %s event: %w", event.Event, err)
+		}
+
+		switch data.Type {
+		case "message_start":
+			completion.Usage.PromptTokens = data.Message.Usage.InputTokens
+			completion.Usage.CompletionTokens = data.Message.Usage.OutputTokens
+		case "content_block_delta":
+			if data.Delta.Type == "text_delta" {
+				completion.Message.Content += data.Delta.Text
+				onDelta(data.Delta.Text)
+			}
+		case "message_delta":
+			completion.FinishReason = data.Delta.StopReason
+			completion.Usage.CompletionTokens = data.Usage.OutputTokens
+		case "error":
+			return nil, &APIError{
+				Provider: "anthropic",
+				Code:     data.Error.Type,
+				Message:  data.Error.Message,
+			}
+		case "message_stop":
+			return completion, nil
+		}
+	}
+
+	return completion, nil
+}
+
+func (p *anthropicProvider) ListModels(ctx context.Context) ([]string, error) {
+	req, err := p.newRequest(ctx, "GET", "/v1/models", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, newAPIError("anthropic", res)
+	}
+
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, model := range list.Data {
+		ids = append(ids, model.ID)
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnthropicMessages(t *testing.T) {
+	system, messages, err := toAnthropicMessages([]Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "Hi"},
+		{Role: "user", Content: "Are you there?"},
+		{Role: "assistant", Content: "Yes."},
+		{Role: "user", Content: ""},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "Be brief.", system)
+	assert.Equal(t, []anthropicMessage{
+		{Role: "user", Content: "Hi\n\nAre you there?"},
+		{Role: "assistant", Content: "Yes."},
+	}, messages)
+
+	_, _, err = toAnthropicMessages([]Message{
+		{Role: "system", Content: "Write a haiku."},
+		{Role: "assistant", Content: "Sushi on my plate"},
+	})
+	assert.Error(t, err)
+}
+
+func TestAnthropicChatStream(t *testing.T) {
+	var received anthropicRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/messages", r.URL.Path)
+		assert.Equal(t, "sk-ant-123", r.Header.Get("x-api-key"))
+		assert.Equal(t, anthropicDefaultVersion, r.Header.Get("anthropic-version"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":25,\"output_tokens\":1}}}\n\n")
+		fmt.Fprint(w, "event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"text\",\"text\":\"\"}}\n\n")
+		fmt.Fprint(w, "event: ping\ndata: {\"type\":\"ping\"}\n\n")
+		for _, text := range []string{"Hello", " there"} {
+			fmt.Fprintf(w, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":%q}}\n\n", text)
+		}
+		fmt.Fprint(w, "event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":0}\n\n")
+		fmt.Fprint(w, "event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"},\"usage\":{\"output_tokens\":12}}\n\n")
+		fmt.Fprint(w, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+	}))
+	defer server.Close()
+
+	config, err := parseConfig(`
+provider = 'anthropic'
+
+[anthropic]
+apikey = 'sk-ant-123'
+base_url = '` + server.URL + `'
+model = 'claude-3-haiku-20240307'
+temperature = 0.5
+	`)
+	assert.NoError(t, err)
+
+	provider, err := newProvider(config)
+	assert.NoError(t, err)
+
+	messages, err := parseTemplate(`# system
+Be brief.
+
+# user
+Hi
+
+# assistant
+Hello!
+
+# user
+Again
+`, nil)
+	assert.NoError(t, err)
+
+	completion, err := provider.ChatStream(context.Background(), messages, func(string) {})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "Be brief.", received.System)
+	assert.Len(t, received.Messages, 3)
+	assert.Equal(t, anthropicDefaultMaxTokens, received.MaxTokens)
+	assert.Equal(t, 0.5, *received.Temperature)
+	assert.True(t, received.Stream)
+
+	assert.Equal(t, "Hello there", completion.Message.Content)
+	assert.Equal(t, "end_turn", completion.FinishReason)
+	assert.Equal(t, Usage{PromptTokens: 25, CompletionTokens: 12}, completion.Usage)
+}
+
+func TestAnthropicStreamError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n")
+	}))
+	defer server.Close()
+
+	config, err := parseConfig(`
+[anthropic]
+base_url = '` + server.URL + `'
+model = 'claude-3-haiku-20240307'
+	`)
+	assert.NoError(t, err)
+
+	provider, err := newProvider(config)
+	assert.NoError(t, err)
+
+	_, err = provider.ChatStream(context.Background(), []Message{{Role: "user", Content: "hi"}}, func(string) {})
+	assert.ErrorContains(t, err, "Overloaded")
+}
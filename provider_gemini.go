@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/alarbada/sira/sse"
+	"github.com/mitchellh/mapstructure"
+)
+
+func init() {
+	registerProvider("gemini", newGeminiProvider)
+	registerProviderSchema("gemini", "toml", geminiConfig{}, generationParams{})
+}
+
+const geminiDefaultBaseURL = "https://generativelanguage.googleapis.com/v1beta"
+
+// geminiConfig is the [gemini] section of the config file. The request
+// fields use the snake_case names of the api in the config file and the
+// camelCase ones on the wire.
+type geminiConfig struct {
+	Apikey    string `toml:"apikey"`
+	ApikeyCmd string `toml:"apikey_cmd"`
+	BaseURL   string `toml:"base_url"`
+	Model     string `toml:"model"`
+	// Stream selects streamGenerateContent over generateContent, true by
+	// default.
+	Stream *bool `toml:"stream"`
+
+	SafetySettings   []geminiSafetySetting  `toml:"safety_settings"`
+	GenerationConfig geminiGenerationConfig `toml:"generation_config"`
+}
+
+type geminiSafetySetting struct {
+	Category  string `json:"category" toml:"category"`
+	Threshold string `json:"threshold" toml:"threshold"`
+}
+
+type geminiGenerationConfig struct {
+	StopSequences   []string `json:"stopSequences,omitempty" toml:"stop_sequences"`
+	CandidateCount  *int     `json:"candidateCount,omitempty" toml:"candidate_count"`
+	MaxOutputTokens *int     `json:"maxOutputTokens,omitempty" toml:"max_output_tokens"`
+	Temperature     *float64 `json:"temperature,omitempty" toml:"temperature"`
+	TopP            *float64 `json:"topP,omitempty" toml:"top_p"`
+	TopK            *int     `json:"topK,omitempty" toml:"top_k"`
+	Seed            *int     `json:"seed,omitempty" toml:"seed"`
+}
+
+type geminiProvider struct {
+	httpClient *http.Client
+	apiKey     string
+	config     geminiConfig
+}
+
+func decodeGeminiConfig(unparsedConfig map[string]any) (*geminiConfig, error) {
+	parsedConfig := new(geminiConfig)
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:  parsedConfig,
+		TagName: "toml",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not create decoder: %w", err)
+	}
+
+	err = decoder.Decode(unparsedConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode config: %w", err)
+	}
+
+	if parsedConfig.Model == "" {
+		return nil, errors.New("gemini: model is required")
+	}
+
+	if parsedConfig.BaseURL == "" {
+		parsedConfig.BaseURL = geminiDefaultBaseURL
+	}
+	parsedConfig.BaseURL = strings.TrimSuffix(parsedConfig.BaseURL, "/")
+
+	if parsedConfig.Stream == nil {
+		stream := true
+		parsedConfig.Stream = &stream
+	}
+
+	params, err := decodeGenerationParams(unparsedConfig)
+	if err != nil {
+		return nil, err
+	}
+	generationConfig := &parsedConfig.GenerationConfig
+	if generationConfig.Temperature == nil {
+		generationConfig.Temperature = params.Temperature
+	}
+	if generationConfig.TopP == nil {
+		generationConfig.TopP = params.TopP
+	}
+	if generationConfig.MaxOutputTokens == nil {
+		generationConfig.MaxOutputTokens = params.MaxTokens
+	}
+	if generationConfig.StopSequences == nil {
+		generationConfig.StopSequences = params.Stop
+	}
+	if generationConfig.Seed == nil {
+		generationConfig.Seed = params.Seed
+	}
+
+	return parsedConfig, nil
+}
+
+func newGeminiProvider(config *configFile, section string) (Provider, error) {
+	parsedConfig, err := decodeGeminiConfig(config.Section(section))
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey, err := config.apiKey(section, parsedConfig.Apikey, parsedConfig.ApikeyCmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return &geminiProvider{
+		httpClient: config.newHTTPClient(),
+		apiKey:     apiKey,
+		config:     *parsedConfig,
+	}, nil
+}
+
+type geminiPart struct {
+	Text string `json:"text"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiRequest struct {
+	Contents          []geminiContent        `json:"contents"`
+	SystemInstruction *geminiContent         `json:"systemInstruction,omitempty"`
+	SafetySettings    []geminiSafetySetting  `json:"safetySettings,omitempty"`
+	GenerationConfig  geminiGenerationConfig `json:"generationConfig"`
+}
+
+// geminiResponse is both the generateContent response and a single chunk of
+// the streamGenerateContent stream.
+type geminiResponse struct {
+	Candidates []struct {
+		Content      geminiContent `json:"content"`
+		FinishReason string        `json:"finishReason"`
+	} `json:"candidates"`
+	PromptFeedback struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+	UsageMetadata struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+	} `json:"usageMetadata"`
+}
+
+// toGeminiContents maps sira roles to gemini ones: assistant messages become
+// "model" turns and system messages the system instruction.
+func toGeminiContents(messages []Message) (*geminiContent, []geminiContent) {
+	var (
+		system   *geminiContent
+		contents []geminiContent
+	)
+
+	for _, msg := range messages {
+		if msg.Content == "" {
+			continue
+		}
+
+		switch msg.Role {
+		case "system":
+			if system == nil {
+				system = &geminiContent{}
+			}
+			system.Parts = append(system.Parts, geminiPart{Text: msg.Content})
+		case "assistant":
+			contents = append(contents, geminiContent{
+				Role:  "model",
+				Parts: []geminiPart{{Text: msg.Content}},
+			})
+		default:
+			contents = append(contents, geminiContent{
+				Role:  "user",
+				Parts: []geminiPart{{Text: msg.Content}},
+			})
+		}
+	}
+
+	return system, contents
+}
+
+func (p *geminiProvider) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, p.config.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("x-goog-api-key", p.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	return req, nil
+}
+
+func (p *geminiProvider) ChatStream(ctx context.Context, messages []Message, onDelta func(string)) (*Completion, error) {
+	system, contents := toGeminiContents(messages)
+
+	body, err := json.Marshal(geminiRequest{
+		Contents:          contents,
+		SystemInstruction: system,
+		SafetySettings:    p.config.SafetySettings,
+		GenerationConfig:  p.config.GenerationConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	path := "/models/" + url.PathEscape(p.config.Model) + ":generateContent"
+	if *p.config.Stream {
+		path = "/models/" + url.PathEscape(p.config.Model) + ":streamGenerateContent?alt=sse"
+	}
+
+	req, err := p.newRequest(ctx, "POST", path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, newAPIError("gemini", res)
+	}
+
+	completion := new(Completion)
+	completion.Message.Role = "assistant"
+
+	if !*p.config.Stream {
+		var response geminiResponse
+		if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+			return nil, err
+		}
+		return completion, completion.addGeminiResponse(&response, onDelta)
+	}
+
+	decoder := sse.NewDecoder(res.Body)
+	for {
+		event, err := decoder.Decode()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		var response geminiResponse
+		if err := json.Unmarshal([]byte(event.Data), &response); err != nil {
+			return nil, fmt.Errorf("gemini: could not decode chunk: %w", err)
+		}
+		if err := completion.addGeminiResponse(&response, onDelta); err != nil {
+			return nil, err
+		}
+	}
+
+	return completion, nil
+}
+
+// addGeminiResponse appends the text of the first candidate of the response
+// to the completion.
+func (completion *Completion) addGeminiResponse(response *geminiResponse, onDelta func(string)) error {
+	if reason := response.PromptFeedback.BlockReason; reason != "" {
+		return fmt.Errorf("gemini: prompt blocked: %s", reason)
+	}
+
+	if response.UsageMetadata.PromptTokenCount > 0 {
+		completion.Usage = Usage{
+			PromptTokens:     response.UsageMetadata.PromptTokenCount,
+			CompletionTokens: response.UsageMetadata.CandidatesTokenCount,
+		}
+	}
+
+	if len(response.Candidates) == 0 {
+		return nil
+	}
+
+	candidate := response.Candidates[0]
+	if candidate.FinishReason != "" {
+		completion.FinishReason = candidate.FinishReason
+	}
+	for _, part := range candidate.Content.Parts {
+		completion.Message.Content += part.Text
+		onDelta(part.Text)
+	}
+
+	return nil
+}
+
+func (p *geminiProvider) ListModels(ctx context.Context) ([]string, error) {
+	req, err := p.newRequest(ctx, "GET", "/models", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, newAPIError("gemini", res)
+	}
+
+	var list struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, model := range list.Models {
+		ids = append(ids, strings.TrimPrefix(model.Name, "models/"))
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeminiChatStream(t *testing.T) {
+	var received map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1beta/models/gemini-1.5-flash:streamGenerateContent", r.URL.Path)
+		assert.Equal(t, "sse", r.URL.Query().Get("alt"))
+		assert.Equal(t, "AIza-123", r.Header.Get("x-goog-api-key"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, text := range []string{"Sushi on", " my plate"} {
+			fmt.Fprintf(w, "data: {\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"text\":%q}]}}]}\r\n\r\n", text)
+		}
+		fmt.Fprint(w, "data: {\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"text\":\"\"}]},\"finishReason\":\"STOP\"}],\"usageMetadata\":{\"promptTokenCount\":10,\"candidatesTokenCount\":5,\"totalTokenCount\":15}}\r\n\r\n")
+	}))
+	defer server.Close()
+
+	config, err := parseConfig(`
+provider = 'gemini'
+
+[gemini]
+apikey = 'AIza-123'
+base_url = '` + server.URL + `/v1beta'
+model = 'gemini-1.5-flash'
+
+[gemini.generation_config]
+temperature = 0.4
+max_output_tokens = 256
+
+[[gemini.safety_settings]]
+category = 'HARM_CATEGORY_HARASSMENT'
+threshold = 'BLOCK_ONLY_HIGH'
+	`)
+	assert.NoError(t, err)
+
+	provider, err := newProvider(config)
+	assert.NoError(t, err)
+
+	messages, err := parseTemplate(`# system
+Write a haiku.
+
+# user
+about sushi
+
+# assistant
+Which kind?
+
+# user
+any`, nil)
+	assert.NoError(t, err)
+
+	completion, err := provider.ChatStream(context.Background(), messages, func(string) {})
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]any{
+		"parts": []any{map[string]any{"text": "Write a haiku."}},
+	}, received["systemInstruction"])
+	contents := received["contents"].([]any)
+	assert.Len(t, contents, 3)
+	assert.Equal(t, "model", contents[1].(map[string]any)["role"])
+	assert.Equal(t, map[string]any{
+		"temperature":     0.4,
+		"maxOutputTokens": 256.0,
+	}, received["generationConfig"])
+	assert.Equal(t, []any{map[string]any{
+		"category":  "HARM_CATEGORY_HARASSMENT",
+		"threshold": "BLOCK_ONLY_HIGH",
+	}}, received["safetySettings"])
+
+	assert.Equal(t, "Sushi on my plate", completion.Message.Content)
+	assert.Equal(t, "STOP", completion.FinishReason)
+	assert.Equal(t, Usage{PromptTokens: 10, CompletionTokens: 5}, completion.Usage)
+}
+
+func TestGeminiBlockedPrompt(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/models/gemini-pro:generateContent", r.URL.Path)
+		fmt.Fprint(w, `{"promptFeedback":{"blockReason":"SAFETY"}}`)
+	}))
+	defer server.Close()
+
+	config, err := parseConfig(`
+[gemini]
+base_url = '` + server.URL + `'
+model = 'gemini-pro'
+stream = false
+	`)
+	assert.NoError(t, err)
+
+	provider, err := newProvider(config)
+	assert.NoError(t, err)
+
+	_, err = provider.ChatStream(context.Background(), []Message{{Role: "user", Content: "hi"}}, func(string) {})
+	assert.ErrorContains(t, err, "SAFETY")
+}
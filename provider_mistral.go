@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/alarbada/sira/mistral"
+)
+
+func init() {
+	registerProvider("mistral", newMistralProvider)
+	registerProviderSchema("mistral", "json", mistral.ChatCompletionRequest{}, mistralConnection{}, generationParams{})
+}
+
+const mistralServer = "https://api.mistral.ai/v1"
+
+type mistralProvider struct {
+	client  *mistral.ClientWithResponses
+	request *mistral.ChatCompletionRequest
+	// stop are the stop sequences, missing from the generated request.
+	stop []string
+}
+
+// mistralConnection holds the settings of the mistral section that are not
+// request parameters.
+type mistralConnection struct {
+	// Apikey overrides the top level apikey for this section.
+	Apikey string `json:"apikey"`
+	// ApikeyCmd is a command printing the api key, like "pass show mistral".
+	ApikeyCmd string `json:"apikey_cmd"`
+	BaseURL   string `json:"base_url"`
+}
+
+func newMistralProvider(config *configFile, section string) (Provider, error) {
+	request, err := decodeMistralRequest(config.Section(section))
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := decodeGenerationParams(config.Section(section))
+	if err != nil {
+		return nil, err
+	}
+
+	connection := mistralConnection{BaseURL: mistralServer}
+	if err := decodeSection(config.Section(section), &connection); err != nil {
+		return nil, err
+	}
+
+	apiKey, err := config.apiKey(section, connection.Apikey, connection.ApikeyCmd)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := mistral.NewClientWithResponses(
+		connection.BaseURL,
+		mistral.WithHTTPClient(config.newHTTPClient()),
+		mistral.WithRequestEditorFn(func(ctx context.Context, req *http.Request) error {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+			return nil
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create mistral client: %w", err)
+	}
+
+	return &mistralProvider{
+		client:  client,
+		request: request,
+		stop:    params.Stop,
+	}, nil
+}
+
+// mistralRequest adds the fields the generated request lacks.
+type mistralRequest struct {
+	mistral.ChatCompletionRequest
+	Stop []string `json:"stop,omitempty"`
+}
+
+// mistralMessage has the same shape as the anonymous message struct of
+// mistral.ChatCompletionRequest, so it can be appended to it.
+type mistralMessage struct {
+	Content *string                                    `json:"content,omitempty"`
+	Role    *mistral.ChatCompletionRequestMessagesRole `json:"role,omitempty"`
+}
+
+func (p *mistralProvider) ChatStream(ctx context.Context, messages []Message, onDelta func(string)) (*Completion, error) {
+	req := *p.request
+	req.Messages = nil
+	for _, msg := range messages {
+		role := mistral.ChatCompletionRequestMessagesRole(msg.Role)
+		content := msg.Content
+		req.Messages = append(req.Messages, mistralMessage{
+			Content: &content,
+			Role:    &role,
+		})
+	}
+
+	body, err := json.Marshal(mistralRequest{ChatCompletionRequest: req, Stop: p.stop})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.client.CreateChatCompletionWithBody(ctx, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, newAPIError("mistral", res)
+	}
+	defer res.Body.Close()
+
+	completion := new(Completion)
+	completion.Message.Role = "assistant"
+
+	stream := mistral.NewChatCompletionStream(res.Body)
+	for stream.Next() {
+		chunk := stream.Current()
+		if chunk.Usage != nil {
+			completion.Usage = Usage{
+				PromptTokens:     chunk.Usage.PromptTokens,
+				CompletionTokens: chunk.Usage.CompletionTokens,
+			}
+		}
+
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+
+		choice := chunk.Choices[0]
+		if choice.FinishReason != nil {
+			completion.FinishReason = string(*choice.FinishReason)
+		}
+
+		completion.Message.Content += choice.Delta.Content
+		onDelta(choice.Delta.Content)
+	}
+	if err := stream.Err(); err != nil {
+		return nil, err
+	}
+
+	return completion, nil
+}
+
+func (p *mistralProvider) ListModels(ctx context.Context) ([]string, error) {
+	res, err := p.client.ListModelsWithResponse(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if res.JSON200 == nil {
+		return nil, &APIError{
+			Provider:   "mistral",
+			StatusCode: res.StatusCode(),
+			Message:    strings.TrimSpace(string(res.Body)),
+		}
+	}
+
+	var ids []string
+	for _, model := range res.JSON200.Data {
+		ids = append(ids, model.Id)
+	}
+
+	return ids, nil
+}
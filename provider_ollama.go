@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+func init() {
+	registerProvider("ollama", newOllamaProvider)
+	registerProviderSchema("ollama", "json", ollamaConfig{}, generationParams{})
+}
+
+const ollamaDefaultBaseURL = "http://localhost:11434"
+
+// ollamaConfig is the [ollama] section of the config file.
+type ollamaConfig struct {
+	BaseURL   string         `json:"base_url"`
+	Model     string         `json:"model"`
+	KeepAlive string         `json:"keep_alive"`
+	Options   map[string]any `json:"options"`
+}
+
+type ollamaProvider struct {
+	httpClient *http.Client
+	config     ollamaConfig
+}
+
+func newOllamaProvider(config *configFile, section string) (Provider, error) {
+	parsedConfig := ollamaConfig{}
+
+	if err := decodeSection(config.Section(section), &parsedConfig); err != nil {
+		return nil, err
+	}
+
+	if parsedConfig.Model == "" {
+		return nil, fmt.Errorf("ollama: model is required")
+	}
+
+	if parsedConfig.BaseURL == "" {
+		parsedConfig.BaseURL = ollamaDefaultBaseURL
+	}
+	parsedConfig.BaseURL = strings.TrimSuffix(parsedConfig.BaseURL, "/")
+
+	params, err := decodeGenerationParams(config.Section(section))
+	if err != nil {
+		return nil, err
+	}
+	parsedConfig.Options = withOllamaParams(parsedConfig.Options, params)
+
+	return &ollamaProvider{
+		httpClient: config.newHTTPClient(),
+		config:     parsedConfig,
+	}, nil
+}
+
+// withOllamaParams returns a copy of options with the neutral params set
+// under their ollama names, the options winning.
+func withOllamaParams(options map[string]any, params *generationParams) map[string]any {
+	merged := map[string]any{"temperature": *params.Temperature}
+	if params.TopP != nil {
+		merged["top_p"] = *params.TopP
+	}
+	if params.MaxTokens != nil {
+		merged["num_predict"] = *params.MaxTokens
+	}
+	if params.Seed != nil {
+		merged["seed"] = *params.Seed
+	}
+	if params.Stop != nil {
+		merged["stop"] = params.Stop
+	}
+
+	for name, value := range options {
+		merged[name] = value
+	}
+	return merged
+}
+
+type ollamaMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type ollamaChatRequest struct {
+	Model     string          `json:"model"`
+	Messages  []ollamaMessage `json:"messages"`
+	Stream    bool            `json:"stream"`
+	KeepAlive string          `json:"keep_alive,omitempty"`
+	Options   map[string]any  `json:"options,omitempty"`
+}
+
+// ollamaChatChunk is a single line of the NDJSON stream returned by /api/chat.
+type ollamaChatChunk struct {
+	Model           string        `json:"model"`
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	DoneReason      string        `json:"done_reason"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	Error           string        `json:"error"`
+}
+
+func (p *ollamaProvider) ChatStream(ctx context.Context, messages []Message, onDelta func(string)) (*Completion, error) {
+	chatRequest := ollamaChatRequest{
+		Model:     p.config.Model,
+		Stream:    true,
+		KeepAlive: p.config.KeepAlive,
+		Options:   p.config.Options,
+	}
+	for _, msg := range messages {
+		chatRequest.Messages = append(chatRequest.Messages, ollamaMessage{
+			Role:    msg.Role,
+			Content: msg.Content,
+		})
+	}
+
+	body, err := json.Marshal(chatRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.config.BaseURL+"/api/chat", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, newAPIError("ollama", res)
+	}
+
+	completion := new(Completion)
+	completion.Message.Role = "assistant"
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var chunk ollamaChatChunk
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			return nil, fmt.Errorf("ollama: could not decode chunk %q: %w", line, err)
+		}
+		if chunk.Error != "" {
+			return nil, &APIError{Provider: "ollama", Message: chunk.Error}
+		}
+
+		if chunk.Message.Content != "" {
+			completion.Message.Content += chunk.Message.Content
+			onDelta(chunk.Message.Content)
+		}
+
+		if chunk.Done {
+			completion.FinishReason = chunk.DoneReason
+			completion.Usage = Usage{
+				PromptTokens:     chunk.PromptEvalCount,
+				CompletionTokens: chunk.EvalCount,
+			}
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return completion, nil
+}
+
+func (p *ollamaProvider) ListModels(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.config.BaseURL+"/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, newAPIError("ollama", res)
+	}
+
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tags); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, model := range tags.Models {
+		ids = append(ids, model.Name)
+	}
+
+	return ids, nil
+}
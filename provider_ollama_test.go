@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOllamaChatStream(t *testing.T) {
+	var received ollamaChatRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/chat", r.URL.Path)
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for _, content := range []string{"Sushi ", "on my ", "plate"} {
+			fmt.Fprintf(w, `{"model":"llama2","message":{"role":"assistant","content":%q},"done":false}`+"\n", content)
+		}
+		fmt.Fprintln(w, `{"model":"llama2","message":{"role":"assistant","content":""},"done":true,"done_reason":"stop","prompt_eval_count":26,"eval_count":3}`)
+	}))
+	defer server.Close()
+
+	config, err := parseConfig(`
+provider = 'ollama'
+
+[ollama]
+base_url = '` + server.URL + `'
+model = 'llama2'
+
+[ollama.options]
+temperature = 0.2
+	`)
+	assert.NoError(t, err)
+
+	provider, err := newProvider(config)
+	assert.NoError(t, err)
+
+	messages, err := parseTemplate(`# system
+Write a haiku about sushi.
+
+# user
+go`, nil)
+	assert.NoError(t, err)
+
+	var streamed string
+	completion, err := provider.ChatStream(context.Background(), messages, func(delta string) {
+		streamed += delta
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "llama2", received.Model)
+	assert.True(t, received.Stream)
+	assert.Equal(t, 0.2, received.Options["temperature"])
+	assert.Equal(t, []ollamaMessage{
+		{Role: "system", Content: "Write a haiku about sushi."},
+		{Role: "user", Content: "go"},
+	}, received.Messages)
+
+	assert.Equal(t, "Sushi on my plate", streamed)
+	assert.Equal(t, Message{Role: "assistant", Content: "Sushi on my plate"}, completion.Message)
+	assert.Equal(t, "stop", completion.FinishReason)
+	assert.Equal(t, Usage{PromptTokens: 26, CompletionTokens: 3}, completion.Usage)
+}
+
+func TestOllamaStreamError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"error":"model 'nope' not found"}`)
+	}))
+	defer server.Close()
+
+	config, err := parseConfig(`
+[ollama]
+base_url = '` + server.URL + `'
+model = 'nope'
+	`)
+	assert.NoError(t, err)
+
+	provider, err := newProvider(config)
+	assert.NoError(t, err)
+
+	_, err = provider.ChatStream(context.Background(), []Message{{Role: "user", Content: "hi"}}, func(string) {})
+	assert.ErrorContains(t, err, "model 'nope' not found")
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func init() {
+	registerProvider("openai", newOpenAIProvider)
+	registerProviderSchema("openai", "json", openai.ChatCompletionRequest{}, openAIConnection{}, generationParams{})
+}
+
+type openAIProvider struct {
+	name        string
+	client      *openai.Client
+	request     *openai.ChatCompletionRequest
+	streamUsage bool
+}
+
+// openAIConnection holds the settings of an openai section that describe
+// where and how to connect, as opposed to the request parameters. They make
+// it possible to target any openai compatible server, like llama.cpp, vLLM,
+// LM Studio or Groq.
+type openAIConnection struct {
+	// Apikey overrides the top level apikey for this section.
+	Apikey string `json:"apikey"`
+	// ApikeyCmd is a command printing the api key, like "pass show openai".
+	ApikeyCmd    string            `json:"apikey_cmd"`
+	BaseURL      string            `json:"base_url"`
+	Organization string            `json:"organization"`
+	Headers      map[string]string `json:"headers"`
+	// NoAuth disables the Authorization header, for local servers.
+	NoAuth bool `json:"no_auth"`
+	// StreamUsage asks for the usage at the end of the stream, true by
+	// default. Servers rejecting the stream_options field need it off, and
+	// their usage is then estimated.
+	StreamUsage *bool `json:"stream_usage"`
+}
+
+func newOpenAIProvider(config *configFile, section string) (Provider, error) {
+	request, err := decodeOpenAIRequest(config.Section(section))
+	if err != nil {
+		return nil, err
+	}
+
+	connection := openAIConnection{}
+	if err := decodeSection(config.Section(section), &connection); err != nil {
+		return nil, err
+	}
+
+	apiKey, err := config.apiKey(section, connection.Apikey, connection.ApikeyCmd)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := decodeGenerationParams(config.Section(section))
+	if err != nil {
+		return nil, err
+	}
+	clientConfig := connection.clientConfig(section, apiKey, params.zeroFloats(), config.newHTTPClient())
+
+	return &openAIProvider{
+		name:        section,
+		client:      openai.NewClientWithConfig(clientConfig),
+		request:     request,
+		streamUsage: connection.StreamUsage == nil || *connection.StreamUsage,
+	}, nil
+}
+
+func (c openAIConnection) clientConfig(provider, apiKey string, zeros []string, httpClient *http.Client) openai.ClientConfig {
+	clientConfig := openai.DefaultConfig(apiKey)
+	if c.BaseURL != "" {
+		clientConfig.BaseURL = strings.TrimSuffix(c.BaseURL, "/")
+	}
+	clientConfig.OrgID = c.Organization
+
+	httpClient.Transport = &openAITransport{
+		base:     httpClient.Transport,
+		provider: provider,
+		headers:  c.Headers,
+		dropAuth: c.NoAuth,
+		zeros:    zeros,
+	}
+	clientConfig.HTTPClient = httpClient
+
+	return clientConfig
+}
+
+// openAITransport sets extra headers on every request, optionally drops the
+// Authorization header set by go-openai, and turns failed responses into
+// APIErrors, which carry more details than the go-openai errors.
+type openAITransport struct {
+	base     http.RoundTripper
+	provider string
+	headers  map[string]string
+	dropAuth bool
+	// zeros are the fields of the request set to 0, which go-openai omits,
+	// and so the api would take its default for them.
+	zeros []string
+}
+
+func (t *openAITransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if t.dropAuth {
+		req.Header.Del("Authorization")
+	}
+	if len(t.zeros) > 0 && req.Body != nil {
+		if err := t.setZeros(req); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= http.StatusBadRequest {
+		return nil, newAPIError(t.provider, res)
+	}
+
+	return res, nil
+}
+
+// setZeros adds the zero fields to the json body of req.
+func (t *openAITransport) setZeros(req *http.Request) error {
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return err
+	}
+	for _, field := range t.zeros {
+		if _, ok := fields[field]; !ok {
+			fields[field] = json.RawMessage("0")
+		}
+	}
+	if body, err = json.Marshal(fields); err != nil {
+		return err
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+	return nil
+}
+
+// toAPIError unwraps the APIError returned by openAITransport, and converts
+// the errors go-openai decodes from the stream itself.
+func (p *openAIProvider) toAPIError(err error) error {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	var openaiErr *openai.APIError
+	if errors.As(err, &openaiErr) {
+		apiErr = &APIError{
+			Provider:   p.name,
+			StatusCode: openaiErr.HTTPStatusCode,
+			Code:       openaiErr.Type,
+			Message:    openaiErr.Message,
+		}
+		if code, ok := openaiErr.Code.(string); ok && code != "" {
+			apiErr.Code = code
+		}
+		return apiErr
+	}
+
+	return err
+}
+
+func (p *openAIProvider) ChatStream(ctx context.Context, messages []Message, onDelta func(string)) (*Completion, error) {
+	req := *p.request
+	// the usage is only sent, with the last chunk, when asked for
+	if p.streamUsage {
+		req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
+	req.Messages = nil
+	for _, msg := range messages {
+		req.Messages = append(req.Messages, openai.ChatCompletionMessage{
+			Role:    msg.Role,
+			Content: msg.Content,
+		})
+	}
+
+	stream, err := p.client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return nil, p.toAPIError(err)
+	}
+	defer stream.Close()
+
+	completion := new(Completion)
+	completion.Message.Role = "assistant"
+
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, p.toAPIError(err)
+		}
+
+		if resp.Usage != nil {
+			completion.Usage = Usage{
+				PromptTokens:     resp.Usage.PromptTokens,
+				CompletionTokens: resp.Usage.CompletionTokens,
+			}
+		}
+
+		if len(resp.Choices) == 0 {
+			continue
+		}
+
+		choice := resp.Choices[0]
+		if choice.FinishReason != "" {
+			completion.FinishReason = string(choice.FinishReason)
+		}
+
+		completion.Message.Content += choice.Delta.Content
+		onDelta(choice.Delta.Content)
+	}
+
+	return completion, nil
+}
+
+func (p *openAIProvider) ListModels(ctx context.Context) ([]string, error) {
+	list, err := p.client.ListModels(ctx)
+	if err != nil {
+		return nil, p.toAPIError(err)
+	}
+
+	var ids []string
+	for _, model := range list.Models {
+		ids = append(ids, model.ID)
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newOpenAIServer returns a fake openai compatible server that streams the
+// given chunks of content, then the usage when the request asks for it, with
+// a token per chunk.
+func newOpenAIServer(t *testing.T, check func(r *http.Request), chunks ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/chat/completions", r.URL.Path)
+		check(r)
+
+		var body struct {
+			StreamOptions struct {
+				IncludeUsage bool `json:"include_usage"`
+			} `json:"stream_options"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":%q}}]}\n\n", chunk)
+		}
+		fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n")
+		if body.StreamOptions.IncludeUsage {
+			fmt.Fprintf(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":8,\"completion_tokens\":%d,\"total_tokens\":%d}}\n\n", len(chunks), 8+len(chunks))
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+}
+
+func TestOpenAICompatibleEndpoint(t *testing.T) {
+	server := newOpenAIServer(t, func(r *http.Request) {
+		assert.Empty(t, r.Header.Get("Authorization"))
+		assert.Equal(t, "yes", r.Header.Get("X-Custom"))
+	}, "Hello", " world")
+	defer server.Close()
+
+	config, err := parseConfig(`
+apikey = 'sk-1234567890'
+provider = 'llamacpp'
+
+[openai]
+model = 'gpt-3.5-turbo'
+
+[llamacpp]
+type = 'openai'
+base_url = '` + server.URL + `/v1/'
+no_auth = true
+model = 'local'
+
+[llamacpp.headers]
+X-Custom = 'yes'
+	`)
+	assert.NoError(t, err)
+
+	provider, err := newProvider(config)
+	assert.NoError(t, err)
+
+	completion, err := provider.ChatStream(context.Background(), []Message{{Role: "user", Content: "hi"}}, func(string) {})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello world", completion.Message.Content)
+	assert.Equal(t, "stop", completion.FinishReason)
+	assert.Equal(t, Usage{PromptTokens: 8, CompletionTokens: 2}, completion.Usage)
+}
+
+func TestOpenAISectionApikey(t *testing.T) {
+	server := newOpenAIServer(t, func(r *http.Request) {
+		assert.Equal(t, "Bearer gsk-123", r.Header.Get("Authorization"))
+	}, "ok")
+	defer server.Close()
+
+	config, err := parseConfig(`
+apikey = 'sk-1234567890'
+
+[openai]
+apikey = 'gsk-123'
+base_url = '` + server.URL + `/v1'
+model = 'llama3-8b-8192'
+	`)
+	assert.NoError(t, err)
+
+	provider, err := newProvider(config)
+	assert.NoError(t, err)
+
+	completion, err := provider.ChatStream(context.Background(), []Message{{Role: "user", Content: "hi"}}, func(string) {})
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", completion.Message.Content)
+}
+
+func TestOpenAIStreamUsageOff(t *testing.T) {
+	server := newOpenAIServer(t, func(r *http.Request) {}, "Hello")
+	defer server.Close()
+
+	config, err := parseConfig(`
+[openai]
+apikey = 'sk-1234567890'
+base_url = '` + server.URL + `/v1'
+model = 'local'
+stream_usage = false
+	`)
+	assert.NoError(t, err)
+	assert.NoError(t, config.validate())
+
+	provider, err := newProvider(config)
+	assert.NoError(t, err)
+
+	completion, err := provider.ChatStream(context.Background(), []Message{{Role: "user", Content: "hi"}}, func(string) {})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", completion.Message.Content)
+	// the server is not asked for the usage, which is estimated when recorded
+	assert.Equal(t, Usage{}, completion.Usage)
+}
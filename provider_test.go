@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectedProvider(t *testing.T) {
+	{ // explicit provider wins over section order
+		config, err := parseConfig(`
+provider = 'mistral'
+
+[openai]
+model = 'gpt-3.5-turbo'
+
+[mistral]
+model = 'mistral-tiny'
+	`)
+		assert.NoError(t, err)
+
+		name, err := config.selectedProvider()
+		assert.NoError(t, err)
+		assert.Equal(t, "mistral", name)
+	}
+
+	{ // openai is picked first when no provider is given
+		config, err := parseConfig(`
+[mistral]
+model = 'mistral-tiny'
+
+[openai]
+model = 'gpt-3.5-turbo'
+	`)
+		assert.NoError(t, err)
+
+		name, err := config.selectedProvider()
+		assert.NoError(t, err)
+		assert.Equal(t, "openai", name)
+	}
+
+	{ // unknown provider
+		config, err := parseConfig(`provider = 'nope'`)
+		assert.NoError(t, err)
+
+		_, err = config.selectedProvider()
+		assert.Error(t, err)
+	}
+}
@@ -1,16 +1,17 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/alarbada/sira/mistral"
@@ -19,209 +20,198 @@ import (
 )
 
 func main() {
-	// disable date on log
-	log.SetFlags(0)
+	// Ctrl-C cancels the request, a second one kills sira right away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	os.Exit(runCLI(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
 
-	mainArg := os.Args[len(os.Args)-1]
-	if mainArg == "help" {
-		fmt.Println("Usage: sira <filename>")
-		return
+// ErrInterrupted is returned by chat when the request is cancelled while the
+// answer is being streamed.
+var ErrInterrupted = errors.New("interrupted")
+
+// interruptedMarker is appended to answers cut short by the user. It is a
+// comment, so it is not sent back to the model.
+const interruptedMarker = TokenKind_Comment + " interrupted"
+
+// chat sends the conversation in filename, rendered with params, to the
+// configured provider, streaming the answer to out, and appends it to the
+// file. The front matter of the file, if any, overrides the config, and the
+// command line flags override both. Messages dropped from the context window
+// are summarized when [context] asks for it, and the summary cached in the
+// file with the answer. The file is left untouched when the request fails,
+// except when ctx is cancelled: whatever was streamed so far is appended
+// with the interrupted marker. Answered requests are recorded in the usage
+// ledger.
+func chat(ctx context.Context, config *configFile, filename string, params *templateParams, out io.Writer) error {
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return err
 	}
 
-	configContents, err := readConfig()
+	doc := parseDocument(string(contents))
+	config, err = config.forDocument(doc, filename)
 	if err != nil {
-		log.Fatalf("could not read ~/.sira.toml file: %v", err)
+		return err
+	}
+	if err := config.validate(); err != nil {
+		return err
 	}
 
-	config, err := parseConfig(configContents)
+	provider, err := newProvider(config)
 	if err != nil {
-		log.Fatalf("could not parse ~/.sira.toml file: %v", err)
+		return err
 	}
 
-	if config.OpenAI != nil {
-		request, err := config.toOpenAIRequest()
-		assertErr(err)
-
-		filename := mainArg
+	values, err := params.resolve(doc, nil)
+	if err != nil {
+		return err
+	}
 
-		messages, err := parseMessagesFromFile(filename)
-		assertErr(err)
+	messages, err := renderDocument(doc, string(contents), filename, values)
+	if err != nil {
+		return err
+	}
 
-		// force getting only the latest 5 messages + the first system message,
-		// otherwise it is easy to consume lots of tokens.
-		// TODO: This is hardcoded, should be configurable
-		if len(messages) > 5 {
-			newMessages := messages[len(messages)-5:]
+	window, err := config.contextWindow()
+	if err != nil {
+		return err
+	}
+	truncated := window.truncate(messages)
+	window.report(truncated)
+	messages = truncated.Kept
 
-			firstMessage := messages[0]
-			if firstMessage.Role == "system" {
-				newMessages = append([]Message{firstMessage}, newMessages...)
+	// a new summary is cached with the answer
+	var newSummary *cachedSummary
+	if len(truncated.Dropped) > 0 {
+		summarizer, err := config.summarizer()
+		if err != nil {
+			return err
+		}
+		if summarizer != nil {
+			summary, isNew, err := summarizer.summarize(ctx, filename, string(contents), doc, truncated.Dropped)
+			if err != nil {
+				return err
+			}
+			messages = withSummary(messages, summary.Text)
+			if isNew {
+				newSummary = summary
 			}
-
-			messages = newMessages
 		}
+	}
 
-		request.Messages = messages
-
-		newMessage, err := execOpenAIPrompt(config.Apikey, request)
-		assertErr(err)
-
-		err = appendMessage(filename, *newMessage)
-		assertErr(err)
-	} else if config.Mistral != nil {
-		request, err := config.toMistralRequest()
-		assertErr(err)
-
-		filename := mainArg
+	if selected, err := config.selectedProvider(); err == nil {
+		verboseLog.Printf("sending %d messages to %s, model %v", len(messages), selected, config.Section(selected)["model"])
+	}
 
-		messages, err := parseMessagesFromFile(filename)
-		assertErr(err)
+	request := newRequest(config, filename, messages)
+	var streamed strings.Builder
+	completion, err := provider.ChatStream(ctx, messages, func(delta string) {
+		streamed.WriteString(delta)
+		fmt.Fprint(out, delta)
+	})
+	fmt.Fprintln(out)
 
-		type Msg struct {
-			Content *string                                    `json:"content,omitempty"`
-			Role    *mistral.ChatCompletionRequestMessagesRole `json:"role,omitempty"`
+	if err != nil && ctx.Err() != nil {
+		if streamed.Len() == 0 {
+			return ErrInterrupted
 		}
 
-		for _, msg := range messages {
-			role := mistral.ChatCompletionRequestMessagesRole(msg.Role)
-			content := msg.Content
-			request.Messages = append(request.Messages, Msg{
-				Content: &content,
-				Role:    &role,
-			})
+		partial := Message{
+			Role:    "assistant",
+			Content: strings.TrimSpace(streamed.String()) + "\n\n" + string(interruptedMarker),
 		}
-
-		newMessage, err := execMistralPrompt(config.Apikey, *request)
-		assertErr(err)
-
-		err = appendMessage(filename, *newMessage)
-		assertErr(err)
+		if err := appendMessage(filename, partial, newSummary); err != nil {
+			return err
+		}
+		if err := request.record(&Completion{Message: Message{Content: streamed.String()}}); err != nil {
+			return fmt.Errorf("could not record usage: %w", err)
+		}
+		return ErrInterrupted
 	}
-}
-
-func assertErr(err error) {
 	if err != nil {
-		log.Fatalf("%v", err)
+		return err
 	}
-}
-
-type Message = openai.ChatCompletionMessage
 
-func execOpenAIPrompt(apiKey string, req *openai.ChatCompletionRequest) (*Message, error) {
-	client := openai.NewClient(apiKey)
-
-	stream, err := client.CreateChatCompletionStream(context.Background(), *req)
-	if err != nil {
-		return nil, err
+	if err := appendMessage(filename, completion.Message, newSummary); err != nil {
+		return err
 	}
-	defer stream.Close()
-
-	var newMessage Message
-	newMessage.Role = "assistant"
+	if err := request.record(completion); err != nil {
+		return fmt.Errorf("could not record usage: %w", err)
+	}
+	return nil
+}
 
-	for {
-		resp, err := stream.Recv()
-		if errors.Is(err, io.EOF) {
-			fmt.Println()
-			break
-		} else if err != nil {
-			return nil, err
+// forDocument returns the config a conversation is sent with: the selected
+// profile overrides the config, the front matter of doc overrides the
+// profile, the overrides of the message triggering the request override the
+// front matter, and the command line flags override them all.
+func (file *configFile) forDocument(doc *Document, filename string) (*configFile, error) {
+	var frontMatter map[string]any
+	if doc.FrontMatter != nil {
+		var err error
+		frontMatter, err = doc.FrontMatter.Values()
+		if err != nil {
+			return nil, fmt.Errorf("%s:%w", filename, err)
 		}
-
-		newMessage.Content += resp.Choices[0].Delta.Content
-		fmt.Printf("%s", resp.Choices[0].Delta.Content)
 	}
 
-	return &newMessage, nil
-}
+	var turnOverrides map[string]any
+	turn := doc.lastTurn()
+	if turn != nil {
+		turnOverrides = turn.Attrs.Overrides
+	}
 
-func execMistralPrompt(apiKey string, req mistral.ChatCompletionRequest) (*Message, error) {
-	client, err := mistral.NewClientWithResponses(
-		"https://api.mistral.ai/v1",
-		mistral.WithRequestEditorFn(func(ctx context.Context, req *http.Request) error {
-			req.Header.Set("Authorization", "Bearer "+apiKey)
-			return nil
-		}),
-	)
+	profile, err := file.selectProfile(frontMatter, turnOverrides, file.flags)
 	if err != nil {
-		return nil, fmt.Errorf("Could not create mistral client: %w", err)
+		return nil, fmt.Errorf("%s: %w", filename, err)
 	}
-
-	ctx := context.Background()
-	res, err := client.CreateChatCompletion(ctx, req)
+	config, err := file.withProfile(profile)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer res.Body.Close()
 
-	var newMessage Message
-	newMessage.Role = "assistant"
+	config, err = config.withDocumentOverrides(frontMatter)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
 
-	reader := bufio.NewReader(res.Body)
-	for {
-		line, err := reader.ReadString('\n')
+	if turnOverrides != nil {
+		config, err = config.withDocumentOverrides(turnOverrides)
 		if err != nil {
-			if err == io.EOF {
-				break // End of stream
-			}
-			fmt.Println("Error reading stream:", err)
-			break
-		}
-		line = strings.TrimSpace(line)
-		if len(line) < len("data: ") {
-			continue // Ignore lines that are too short
-		} else if line == "data: [DONE]" {
-			break // End of stream
-		}
-
-		line = line[len("data: "):] // Remove the "data: " prefix
-
-		var resp struct {
-			ID      string `json:"id"`
-			Object  string `json:"object"`
-			Created int    `json:"created"`
-			Model   string `json:"model"`
-			Choices []struct {
-				Index int `json:"index"`
-				Delta struct {
-					Role    *string `json:"role"`
-					Content string  `json:"content"`
-				} `json:"delta"`
-				FinishReason string `json:"finish_reason"`
-			} `json:"choices"`
-		}
-
-		if err := json.Unmarshal([]byte(line), &resp); err != nil {
-			fmt.Println("Error unmarshalling JSON:", err)
-			fmt.Println("tried to parse line:", line)
-			break
+			return nil, fmt.Errorf("%s:%v: %w", filename, turn.Header.Start, err)
 		}
+	}
 
-		newMessage.Content += resp.Choices[0].Delta.Content
-		fmt.Printf("%s", resp.Choices[0].Delta.Content)
+	config, err = config.withOverrides(file.flags)
+	if err != nil {
+		return nil, err
 	}
 
-	return &newMessage, nil
+	return config.withModelAlias()
 }
 
-func appendMessage(filename string, message Message) error {
-	f, err := os.OpenFile(filename, os.O_APPEND|os.O_RDWR, 0644)
+// appendMessage appends the answer message to filename, followed by an empty
+// user message, and caches summary in it when set.
+func appendMessage(filename string, message Message, summary *cachedSummary) error {
+	contents, err := os.ReadFile(filename)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	src := string(contents)
 
-	// get last character from file
-	contents, err := io.ReadAll(f)
-	if err != nil {
-		return err
+	if summary != nil {
+		if src, err = insertSummary(src, summary); err != nil {
+			return fmt.Errorf("could not cache the summary: %w", err)
+		}
 	}
 
-	chars := []rune(string(contents))
-	lastChar := chars[len(chars)-1]
-
 	start := "\n\n"
-	if lastChar == '\n' {
+	if strings.HasSuffix(src, "\n") {
 		start = "\n"
 	}
 
@@ -230,8 +220,37 @@ func appendMessage(filename string, message Message) error {
 		start, TokenKind_Assistant, message.Content, TokenKind_User,
 	)
 
-	_, err = f.WriteString(toBeAppended)
-	return err
+	return replaceFile(filename, []byte(src+toBeAppended))
+}
+
+// replaceFile replaces the contents of filename, keeping its mode. The
+// contents are written to a temporary file renamed over filename, so an
+// interrupted write never leaves the conversation half written.
+func replaceFile(filename string, contents []byte) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(info.Mode().Perm()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filename)
 }
 
 func startTemplate(dir string) error {
@@ -256,228 +275,305 @@ max_tokens = 500
 	return os.WriteFile(dir+"/template.md", []byte(TokenKind_System), 0644)
 }
 
-func readConfig() (string, error) {
-	home, err := os.UserHomeDir()
+// runTemplate renders the template in dir, created with startTemplate, into a
+// new timestamped conversation file next to it, and sends it to the provider.
+// The [params] of params.toml are the defaults of params, and its other
+// settings are written as the front matter of the conversation, so they keep
+// applying when the conversation goes on.
+func runTemplate(ctx context.Context, config *configFile, dir string, params *templateParams, out io.Writer) error {
+	settings, messages, err := renderTemplateDir(dir, params)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	bs, err := os.ReadFile(home + "/.sira.toml")
-	return string(bs), err
-}
-
-type configFile struct {
-	Apikey  string
-	OpenAI  map[string]any
-	Mistral map[string]any
-}
-
-func parseConfig(contents string) (*configFile, error) {
-	params := new(configFile)
-	_, err := toml.Decode(contents, params)
-	return params, err
-}
-
-func (file *configFile) toOpenAIRequest() (*openai.ChatCompletionRequest, error) {
-	unparsedConfig := file.OpenAI
-	parsedConfig := new(openai.ChatCompletionRequest)
+	var conversation bytes.Buffer
+	if err := writeConversation(&conversation, settings, messages, true); err != nil {
+		return err
+	}
 
-	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
-		Result:  parsedConfig,
-		TagName: "json",
-	})
+	filename := filepath.Join(dir, time.Now().Format("2006-01-02T15-04-05")+".md")
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
 	if err != nil {
-		return nil, fmt.Errorf("Could not create decoder: %w", err)
+		return err
+	}
+	if _, err := f.Write(conversation.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
 	}
 
-	err = decoder.Decode(unparsedConfig)
-	return parsedConfig, err
+	return chat(ctx, config, filename, nil, out)
 }
 
-func (file *configFile) toMistralRequest() (*mistral.ChatCompletionRequest, error) {
-	unparsedConfig := file.Mistral
-	parsedConfig := new(mistral.ChatCompletionRequest)
+// renderTemplateDir renders the template.md of dir with params, completed by
+// the [params] of its params.toml. It returns the other settings of
+// params.toml with the messages.
+func renderTemplateDir(dir string, params *templateParams) (map[string]any, []Message, error) {
+	var settings map[string]any
+	if _, err := toml.DecodeFile(filepath.Join(dir, "params.toml"), &settings); err != nil {
+		return nil, nil, err
+	}
 
-	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
-		Result:  parsedConfig,
-		TagName: "json",
-	})
+	defaults, _ := settings["params"].(map[string]any)
+	delete(settings, "params")
+
+	templateFile := filepath.Join(dir, "template.md")
+	template, err := os.ReadFile(templateFile)
 	if err != nil {
-		return nil, fmt.Errorf("Could not create decoder: %w", err)
+		return nil, nil, err
 	}
 
-	err = decoder.Decode(unparsedConfig)
+	doc := parseDocument(string(template))
+	values, err := params.resolve(doc, defaults)
 	if err != nil {
-		return nil, fmt.Errorf("Could not decode config: %w", err)
+		return nil, nil, err
 	}
 
-	if parsedConfig.TopP == nil {
-		var topP float32 = 1.0
-		parsedConfig.TopP = &topP
+	messages, err := renderDocument(doc, string(template), templateFile, values)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if parsedConfig.MaxTokens == nil {
-		var maxTokens int = 1500
-		parsedConfig.MaxTokens = &maxTokens
+	return settings, messages, nil
+}
+
+// writeConversation writes messages as a conversation file, with settings as
+// its toml front matter. When escape is set, the tags in the messages are
+// escaped, so the file renders to the same messages.
+func writeConversation(w io.Writer, settings map[string]any, messages []Message, escape bool) error {
+	var conversation bytes.Buffer
+	if len(settings) > 0 {
+		conversation.WriteString(frontMatterTOML + "\n")
+		if err := toml.NewEncoder(&conversation).Encode(settings); err != nil {
+			return err
+		}
+		conversation.WriteString(frontMatterTOML + "\n")
 	}
-	if parsedConfig.Temperature == nil {
-		var temperature float32 = 0.7
-		parsedConfig.Temperature = &temperature
+	for i, message := range messages {
+		content := message.Content
+		if escape && message.Role != "assistant" {
+			content = escapeTemplate(content)
+		}
+		if i > 0 {
+			conversation.WriteString("\n")
+		}
+		fmt.Fprintf(&conversation, "%v%s\n%s\n", roleTokenKind(message.Role), message.headerAttrs(), content)
 	}
 
-	stream := true
-	parsedConfig.Stream = &stream
+	_, err := w.Write(conversation.Bytes())
+	return err
+}
 
-	if parsedConfig.SafeMode == nil {
-		safeMode := true
-		parsedConfig.SafeMode = &safeMode
-	}
+func readConfig(path string) (string, error) {
+	bs, err := os.ReadFile(path)
+	return string(bs), err
+}
 
-	if parsedConfig.RandomSeed == nil {
-		var randomSeed int = 0
-		parsedConfig.RandomSeed = &randomSeed
+type configFile struct {
+	Apikey string
+	// ApikeyCmd is a command printing the api key shared by the providers.
+	ApikeyCmd string `toml:"apikey_cmd"`
+
+	// Provider is the name of the provider to use. When empty, the first
+	// configured provider section is used.
+	Provider string
+
+	// DefaultProfile is the profile used when neither the command line nor
+	// the conversation selects one.
+	DefaultProfile string `toml:"default_profile"`
+
+	HTTP httpConfig `toml:"http"`
+
+	// profile is the name of the applied profile, if any.
+	profile string
+
+	// flags are the settings given on the command line, like --model. They
+	// win over the front matter of a conversation.
+	flags map[string]any
+
+	// sections holds every top level table of the file, keyed by name.
+	sections map[string]map[string]any
+
+	// unknownKeys are the top level keys that aren't sections nor settings.
+	unknownKeys []string
+
+	// origins maps the dotted path of each setting to the file or the
+	// environment variable it comes from.
+	origins map[string]string
+}
+
+func parseConfig(contents string) (*configFile, error) {
+	params := new(configFile)
+	metadata, err := toml.Decode(contents, params)
+	if err != nil {
+		return nil, err
 	}
 
-	if parsedConfig.Model == "" {
-		panic("model is required")
+	var raw map[string]any
+	if _, err := toml.Decode(contents, &raw); err != nil {
+		return nil, err
 	}
 
-	return parsedConfig, nil
-}
+	for _, key := range metadata.Undecoded() {
+		if _, isTable := raw[key[0]].(map[string]any); len(key) == 1 && !isTable {
+			params.unknownKeys = append(params.unknownKeys, key[0])
+		}
+	}
 
-func stringMatches(index int, substr, content string) bool {
-	if index+len(substr) >= len(content) {
-		return false
+	params.sections = make(map[string]map[string]any)
+	for name, value := range raw {
+		if table, ok := value.(map[string]any); ok {
+			params.sections[name] = table
+		}
 	}
 
-	return substr == content[index:index+len(substr)]
+	return params, nil
 }
 
-type TokenKind string
-
-const (
-	TokenKind_System    TokenKind = "# system"
-	TokenKind_Assistant TokenKind = "# assistant"
-	TokenKind_User      TokenKind = "# user"
-	TokenKind_Comment   TokenKind = ">>>"
-)
+// Section returns the table with the given name, or nil if it is not present.
+func (file *configFile) Section(name string) map[string]any {
+	return file.sections[name]
+}
 
-func (this TokenKind) ToRole() string {
-	switch this {
-	case TokenKind_System:
-		return "system"
-	case TokenKind_Assistant:
-		return "assistant"
-	case TokenKind_User:
-		return "user"
+// decodeSection decodes a config table into result, using the json tags of
+// its fields as keys.
+func decodeSection(section map[string]any, result any) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:  result,
+		TagName: "json",
+	})
+	if err != nil {
+		return fmt.Errorf("Could not create decoder: %w", err)
 	}
 
-	panic("unreachable")
-}
+	if err := decoder.Decode(section); err != nil {
+		return fmt.Errorf("Could not decode config: %w", err)
+	}
 
-type Token struct {
-	Kind TokenKind
-	Pos  int
+	return nil
 }
 
-type TokenizerState uint8
+func decodeOpenAIRequest(unparsedConfig map[string]any) (*openai.ChatCompletionRequest, error) {
+	parsedConfig := new(openai.ChatCompletionRequest)
+	if err := decodeSection(unparsedConfig, parsedConfig); err != nil {
+		return nil, err
+	}
 
-const (
-	TokenizerState_ParseRole TokenizerState = iota
-	TokenizerState_ParseContent
-)
+	params, err := decodeGenerationParams(unparsedConfig)
+	if err != nil {
+		return nil, err
+	}
+	parsedConfig.Temperature = float32(*params.Temperature)
+	if params.TopP != nil {
+		parsedConfig.TopP = float32(*params.TopP)
+	}
 
-type Tokenizer struct {
-	State TokenizerState
+	return parsedConfig, nil
 }
 
-func tokenize(rawTemplate string) []Token {
-	var tokens []Token
-	for i := 0; i < len(rawTemplate); i++ {
-
-		switch {
-		case stringMatches(i, string(TokenKind_System), rawTemplate):
-			tokens = append(tokens, Token{
-				Kind: TokenKind_System,
-				Pos:  i,
-			})
-			i += len(TokenKind_System)
-			continue
+func decodeMistralRequest(unparsedConfig map[string]any) (*mistral.ChatCompletionRequest, error) {
+	parsedConfig := new(mistral.ChatCompletionRequest)
+	if err := decodeSection(unparsedConfig, parsedConfig); err != nil {
+		return nil, err
+	}
 
-		case stringMatches(i, string(TokenKind_Assistant), rawTemplate):
-			tokens = append(tokens, Token{
-				Kind: TokenKind_Assistant,
-				Pos:  i,
-			})
-			i += len(TokenKind_Assistant)
-			continue
+	params, err := decodeGenerationParams(unparsedConfig)
+	if err != nil {
+		return nil, err
+	}
+	parsedConfig.Temperature = float32Value(params.Temperature)
+	parsedConfig.TopP = float32Value(params.TopP)
+	if parsedConfig.RandomSeed == nil {
+		parsedConfig.RandomSeed = params.Seed
+	}
 
-		case stringMatches(i, string(TokenKind_User), rawTemplate):
-			tokens = append(tokens, Token{
-				Kind: TokenKind_User,
-				Pos:  i,
-			})
-			i += len(TokenKind_User)
-			continue
-		}
+	stream := true
+	parsedConfig.Stream = &stream
+
+	if parsedConfig.Model == "" {
+		return nil, errors.New("mistral: model is required")
 	}
 
-	return tokens
+	return parsedConfig, nil
 }
 
+// parseTemplate parses a conversation and renders its messages with params.
+// Every param has to be used by the template.
 func parseTemplate(template string, params map[string]any) ([]Message, error) {
-	templateFileLines := strings.Split(template, "\n")
-	var withoutComments []string
-	for _, line := range templateFileLines {
-		if strings.Index(line, string(TokenKind_Comment)) != 0 {
-			withoutComments = append(withoutComments, line)
-		}
-	}
+	return renderDocument(parseDocument(template), template, "", params)
+}
 
-	template = strings.Join(withoutComments, "\n")
+// renderDocument renders the messages of doc, parsed from src, with params.
+// Assistant messages are answers of the model and are never rendered, and
+// skipped messages are left out.
+// Template errors are reported with their position in filename.
+func renderDocument(doc *Document, src, filename string, params map[string]any) ([]Message, error) {
+	var (
+		messages []Message
+		errs     []error
+		used     = make(map[string]bool)
+	)
 
-	for k, v := range params {
-		if !strings.Contains(template, "{"+k+"}") {
-			return nil, fmt.Errorf("Could not find parameter \"%s\" in template", k)
+	for _, node := range doc.Messages {
+		if node.AttrsErr != nil {
+			node.AttrsErr.Filename = filename
+			errs = append(errs, node.AttrsErr)
+			continue
 		}
+		if node.Attrs.Skip {
+			continue
+		}
+		content := node.Content
 
-		switch val := v.(type) {
-		case string:
-			template = strings.ReplaceAll(template, "{"+k+"}", val)
-		case int64:
-			template = strings.ReplaceAll(template, "{"+k+"}", fmt.Sprintf("%d", val))
-		default:
-			return nil, fmt.Errorf("Unknown type %T", val)
+		if node.Role != "assistant" {
+			tmpl, err := compileTemplate(node.Content)
+			if err != nil {
+				errs = append(errs, node.templateError(src, filename, err.(*TemplateError)))
+				continue
+			}
+			messageUsed, _ := tmpl.params()
+			for _, name := range messageUsed {
+				used[name] = true
+			}
+
+			rendered, renderErrs := tmpl.render(params)
+			for _, err := range renderErrs {
+				errs = append(errs, node.templateError(src, filename, err))
+			}
+			content = rendered
 		}
+
+		messages = append(messages, Message{
+			Role:      node.Role,
+			Content:   content,
+			Pinned:    node.Attrs.Pin,
+			Overrides: node.Attrs.Overrides,
+		})
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
 	}
 
-	var messages []Message
-	tokens := tokenize(template)
-	for i, token := range tokens {
-		isLast := i == len(tokens)-1
-		if isLast {
-			content := template[token.Pos+len(token.Kind):]
-			messages = append(messages, Message{
-				Role:    token.Kind.ToRole(),
-				Content: strings.TrimSpace(content),
-			})
-		} else {
-			content := template[token.Pos+len(token.Kind) : tokens[i+1].Pos]
-			messages = append(messages, Message{
-				Role:    token.Kind.ToRole(),
-				Content: strings.TrimSpace(content),
-			})
+	var names []string
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !used[name] {
+			return nil, fmt.Errorf("Could not find parameter \"%s\" in template", name)
 		}
 	}
 
 	return messages, nil
 }
 
-func parseMessagesFromFile(filename string) ([]Message, error) {
-	f, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, err
-	}
-
-	return parseTemplate(string(f), nil)
+// templateError sets the file position of an error in the content of node.
+func (node *MessageNode) templateError(src, filename string, err *TemplateError) *TemplateError {
+	err.Filename = filename
+	err.Pos = node.contentPos(src, err.Pos.Offset)
+	return err
 }
@@ -1,12 +1,43 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/sashabaranov/go-openai"
 	"github.com/stretchr/testify/assert"
 )
 
+// TestMain keeps the tests from writing to the usage ledger of the user, and
+// from reading the config of the environment.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "sira-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("XDG_STATE_HOME", dir)
+
+	for _, name := range apiKeyEnv {
+		os.Unsetenv(name)
+	}
+	for _, variable := range os.Environ() {
+		if name, _, _ := strings.Cut(variable, "="); strings.HasPrefix(name, configEnvPrefix) {
+			os.Unsetenv(name)
+		}
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 func TestParseMessages(t *testing.T) {
 	t.Run("simple", func(t *testing.T) {
 		messages, err := parseTemplate(`# assistant
@@ -134,7 +165,7 @@ top_p = 1
 
 		assert.Equal(t, "sk-1234567890", config.Apikey)
 
-		request, err := config.toOpenAIRequest()
+		request, err := decodeOpenAIRequest(config.Section("openai"))
 		assert.NoError(t, err)
 
 		assert.Equal(t, "gpt-3.5-turbo", request.Model)
@@ -161,7 +192,7 @@ top_p = 1
 
 		assert.Equal(t, "sk-1234567890", config.Apikey)
 
-		request, err := config.toMistralRequest()
+		request, err := decodeMistralRequest(config.Section("mistral"))
 		assert.NoError(t, err)
 
 		assert.Equal(t, "mistral-tiny", request.Model)
@@ -172,3 +203,119 @@ top_p = 1
 		assert.Equal(t, topP, *request.TopP)
 	}
 }
+
+func TestChatInterrupted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"Sushi on"},"done":false}`)
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":" my plate"},"done":false}`)
+		w.(http.Flusher).Flush()
+
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	config, err := parseConfig(`
+[ollama]
+base_url = '` + server.URL + `'
+model = 'llama2'
+	`)
+	assert.NoError(t, err)
+
+	filename := filepath.Join(t.TempDir(), "chat.md")
+	assert.NoError(t, os.WriteFile(filename, []byte("# user\nWrite a haiku about sushi.\n"), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out := &cancelAfterWriter{cancel: cancel, after: "my plate"}
+
+	err = chat(ctx, config, filename, nil, out)
+	assert.ErrorIs(t, err, ErrInterrupted)
+
+	contents, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, `# user
+Write a haiku about sushi.
+
+# assistant
+Sushi on my plate
+
+>>> interrupted
+
+# user
+
+`, string(contents))
+
+	messages, err := parseTemplate(string(contents), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Message{Role: "assistant", Content: "Sushi on my plate"}, messages[1])
+}
+
+// cancelAfterWriter cancels a context once the given text was written to it.
+type cancelAfterWriter struct {
+	strings.Builder
+	cancel context.CancelFunc
+	after  string
+}
+
+func (w *cancelAfterWriter) Write(p []byte) (int, error) {
+	n, err := w.Builder.Write(p)
+	if strings.Contains(w.String(), w.after) {
+		w.cancel()
+	}
+	return n, err
+}
+
+func TestRunTemplate(t *testing.T) {
+	var received ollamaChatRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"Colors arc the sky"},"done":true}`)
+	}))
+	defer server.Close()
+
+	config, err := parseConfig(`
+provider = 'ollama'
+
+[ollama]
+base_url = '` + server.URL + `'
+model = 'llama2'
+	`)
+	assert.NoError(t, err)
+
+	dir := filepath.Join(t.TempDir(), "haiku")
+	assert.NoError(t, startTemplate(dir))
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "params.toml"), []byte(`
+[params]
+topic = "rainbows"
+example = "{name}"
+
+[ollama]
+model = "mistral"
+`), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "template.md"), []byte("# system\nWrite a haiku about {topic}, like {example}.\n"), 0644))
+
+	assert.NoError(t, runTemplate(context.Background(), config, dir, nil, &strings.Builder{}))
+
+	assert.Equal(t, "mistral", received.Model)
+	assert.Equal(t, []ollamaMessage{{Role: "system", Content: "Write a haiku about rainbows, like {name}."}}, received.Messages)
+
+	conversations, err := filepath.Glob(filepath.Join(dir, "*-*.md"))
+	assert.NoError(t, err)
+	if assert.Len(t, conversations, 1) {
+		contents, err := os.ReadFile(conversations[0])
+		assert.NoError(t, err)
+		assert.Equal(t, `+++
+[ollama]
+  model = "mistral"
++++
+# system
+Write a haiku about rainbows, like \{name}.
+
+# assistant
+Colors arc the sky
+
+# user
+
+`, string(contents))
+	}
+}
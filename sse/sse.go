@@ -0,0 +1,85 @@
+// Package sse decodes server-sent event streams, as sent by the streaming
+// apis of the providers.
+package sse
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Event is a single server-sent event.
+type Event struct {
+	Event string
+	Data  string
+	ID    string
+	// Retry is the reconnection time in milliseconds, 0 when not sent.
+	Retry int
+}
+
+// Decoder reads server-sent events from a stream, following
+// https://html.spec.whatwg.org/multipage/server-sent-events.html
+type Decoder struct {
+	reader *bufio.Reader
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{reader: bufio.NewReader(r)}
+}
+
+// Decode returns the next event of the stream, or io.EOF once the stream is
+// over. Comments are skipped, multi-line data fields are joined with "\n" and
+// blocks without data are not dispatched.
+func (d *Decoder) Decode() (*Event, error) {
+	var (
+		event   Event
+		data    []string
+		hasData bool
+	)
+
+	for {
+		line, err := d.reader.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			if err == io.EOF && hasData {
+				// the stream ended without the final blank line
+				event.Data = strings.Join(data, "\n")
+				return &event, nil
+			}
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		line = strings.TrimSuffix(line, "\r")
+
+		if line == "" {
+			if !hasData {
+				// a blank line without data only resets the event name
+				event = Event{}
+				continue
+			}
+			event.Data = strings.Join(data, "\n")
+			return &event, nil
+		}
+
+		if strings.HasPrefix(line, ":") {
+			continue // comment
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+
+		switch field {
+		case "event":
+			event.Event = value
+		case "data":
+			data = append(data, value)
+			hasData = true
+		case "id":
+			event.ID = value
+		case "retry":
+			if retry, err := strconv.Atoi(value); err == nil {
+				event.Retry = retry
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package sse
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeAll(t *testing.T, input string) []Event {
+	decoder := NewDecoder(strings.NewReader(input))
+
+	var events []Event
+	for {
+		event, err := decoder.Decode()
+		if errors.Is(err, io.EOF) {
+			return events
+		}
+		assert.NoError(t, err)
+		events = append(events, *event)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	t.Run("fields", func(t *testing.T) {
+		events := decodeAll(t, ": keep-alive\n\nevent: delta\nid: 1\nretry: 3000\ndata: first\ndata:second\n\ndata: {\"a\":1}\r\n\r\n")
+
+		assert.Equal(t, []Event{
+			{Event: "delta", ID: "1", Retry: 3000, Data: "first\nsecond"},
+			{Data: `{"a":1}`},
+		}, events)
+	})
+
+	t.Run("no trailing blank line", func(t *testing.T) {
+		events := decodeAll(t, "data: last")
+		assert.Equal(t, []Event{{Data: "last"}}, events)
+	})
+
+	t.Run("event name without data is not dispatched", func(t *testing.T) {
+		events := decodeAll(t, "event: ping\n\ndata: x\n\n")
+		assert.Equal(t, []Event{{Data: "x"}}, events)
+	})
+}
+
+func FuzzDecoder(f *testing.F) {
+	f.Add("data: {\"choices\":[]}\n\ndata: [DONE]\n\n")
+	f.Add("event: error\ndata: a\ndata: b\r\n\r\n: comment\nretry: x\n")
+	f.Add("data")
+	f.Add("\n\n\n:")
+
+	f.Fuzz(func(t *testing.T, input string) {
+		decoder := NewDecoder(strings.NewReader(input))
+		for i := 0; ; i++ {
+			if i > len(input) {
+				t.Fatalf("decoded more events than input bytes")
+			}
+
+			event, err := decoder.Decode()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				break
+			}
+			if strings.Contains(event.Event, "\n") || strings.Contains(event.ID, "\n") {
+				t.Fatalf("field spans several lines: %+v", event)
+			}
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A summary of the messages dropped from the context window is cached in the
+// conversation file as a comment block, keyed by a hash of those messages:
+//
+//	>>> summary 3f2a9c0e1b7d4a6f
+//	>>> The user is writing a parser in go...
+//	>>> end summary
+//
+// Comments are never sent, so the block only costs tokens once injected as
+// a system message.
+const (
+	summaryStartMarker = TokenKind_Comment + " summary "
+	summaryEndMarker   = TokenKind_Comment + " end summary"
+)
+
+// defaultSummaryTokens is the room left in the context window for the
+// summary, when summary_tokens is not set.
+const defaultSummaryTokens = 500
+
+const summaryPrompt = `Summarize the beginning of a conversation between a user and an assistant, which is cut from what the assistant sees next. Keep the facts, decisions, names, numbers, code identifiers and open questions the rest of the conversation may rely on. Answer with the summary only, in at most %d words.`
+
+// summaryIntro introduces the summary to the model answering the
+// conversation.
+const summaryIntro = "Summary of the earlier part of the conversation, which is not shown:\n\n"
+
+// summarizer writes the summaries of the messages dropped from the context
+// window.
+type summarizer struct {
+	// config selects the provider and model writing the summaries.
+	config *configFile
+	// maxTokens is the size of a summary.
+	maxTokens int
+}
+
+// summarizer returns the summarizer configured in [context], nil when
+// summaries are disabled. The summary_provider and summary_model settings
+// pick another, usually cheaper, model than the conversation.
+func (file *configFile) summarizer() (*summarizer, error) {
+	config, err := decodeContextConfig(file.Section("context"))
+	if err != nil {
+		return nil, err
+	}
+	if !config.Summarize {
+		return nil, nil
+	}
+
+	overrides := make(map[string]any)
+	if config.SummaryProvider != "" {
+		overrides["provider"] = config.SummaryProvider
+	}
+	if config.SummaryModel != "" {
+		overrides["model"] = config.SummaryModel
+	}
+
+	summaryConfig, err := file.withOverrides(overrides)
+	if err == nil {
+		summaryConfig, err = summaryConfig.withModelAlias()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("context: %w", err)
+	}
+
+	return &summarizer{config: summaryConfig, maxTokens: config.summaryTokens()}, nil
+}
+
+// summarize returns the summary of messages, from the cache in the file when
+// it is there, and asks the model for it otherwise. src and doc are the
+// contents of filename. A new summary is reported as such, to be cached in
+// the file with the answer, once the request succeeded.
+func (s *summarizer) summarize(ctx context.Context, filename, src string, doc *Document, messages []Message) (*cachedSummary, bool, error) {
+	hash := hashMessages(messages)
+	for _, cached := range findSummaries(src, doc) {
+		if cached.Hash == hash {
+			verboseLog.Printf("context: using the cached summary of %d messages", len(messages))
+			return &cached, false, nil
+		}
+	}
+
+	provider, err := newProvider(s.config)
+	if err != nil {
+		return nil, false, fmt.Errorf("summary: %w", err)
+	}
+	if selected, err := s.config.selectedProvider(); err == nil {
+		verboseLog.Printf("context: summarizing %d messages with %s, model %v", len(messages), selected, s.config.Section(selected)["model"])
+	}
+
+	var transcript strings.Builder
+	for _, message := range messages {
+		fmt.Fprintf(&transcript, "%s:\n%s\n\n", message.Role, message.Content)
+	}
+	prompt := []Message{
+		{Role: "system", Content: fmt.Sprintf(summaryPrompt, s.maxTokens*3/4)},
+		{Role: "user", Content: strings.TrimSpace(transcript.String())},
+	}
+	request := newRequest(s.config, filename, prompt)
+	request.summary = true
+	completion, err := provider.ChatStream(ctx, prompt, func(string) {})
+	if err != nil {
+		return nil, false, fmt.Errorf("summary: %w", err)
+	}
+	if err := request.record(completion); err != nil {
+		return nil, false, fmt.Errorf("could not record usage: %w", err)
+	}
+
+	return &cachedSummary{Hash: hash, Text: strings.TrimSpace(completion.Message.Content)}, true, nil
+}
+
+// withSummary returns messages with the summary injected as a system message,
+// after the leading system messages.
+func withSummary(messages []Message, summary string) []Message {
+	i := 0
+	for i < len(messages) && messages[i].Role == "system" {
+		i++
+	}
+
+	result := append([]Message{}, messages[:i]...)
+	result = append(result, Message{Role: "system", Content: summaryIntro + summary})
+	return append(result, messages[i:]...)
+}
+
+// hashMessages returns a short hash of the roles and contents of messages.
+func hashMessages(messages []Message) string {
+	h := sha256.New()
+	for _, message := range messages {
+		fmt.Fprintf(h, "%s\x00%s\x00", message.Role, message.Content)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// cachedSummary is a summary block of a conversation file.
+type cachedSummary struct {
+	Hash string
+	Text string
+	// Span covers the block, from the start marker to the end marker.
+	Span Span
+}
+
+// findSummaries returns the summary blocks of a conversation, in order.
+// Blocks without an end marker are ignored.
+func findSummaries(src string, doc *Document) []cachedSummary {
+	var summaries []cachedSummary
+
+	var current *cachedSummary
+	var lines []string
+	for _, comment := range doc.Comments {
+		line := src[comment.Start.Offset:comment.End.Offset]
+
+		if current != nil && comment.Start.Line != current.Span.End.Line+1 {
+			current = nil
+		}
+
+		switch {
+		case strings.HasPrefix(line, string(summaryStartMarker)):
+			current = &cachedSummary{
+				Hash: strings.TrimSpace(strings.TrimPrefix(line, string(summaryStartMarker))),
+				Span: comment,
+			}
+			lines = nil
+
+		case current == nil:
+
+		case strings.TrimRight(line, " \t") == string(summaryEndMarker):
+			current.Span.End = comment.End
+			current.Text = strings.TrimSpace(strings.Join(lines, "\n"))
+			summaries = append(summaries, *current)
+			current = nil
+
+		default:
+			current.Span.End = comment.End
+			line = strings.TrimPrefix(line, string(TokenKind_Comment))
+			lines = append(lines, strings.TrimPrefix(line, " "))
+		}
+	}
+
+	return summaries
+}
+
+// insertSummary replaces the summary blocks of src with summary, placed
+// before the first message.
+func insertSummary(src string, summary *cachedSummary) (string, error) {
+	doc := parseDocument(src)
+
+	var cleaned strings.Builder
+	offset := 0
+	for _, cached := range findSummaries(src, doc) {
+		cleaned.WriteString(src[offset:cached.Span.Start.Offset])
+		offset = skipLine(src, cached.Span.End.Offset)
+	}
+	cleaned.WriteString(src[offset:])
+	src = cleaned.String()
+
+	doc = parseDocument(src)
+	if len(doc.Messages) == 0 {
+		return "", errors.New("the conversation has no messages")
+	}
+	insert := doc.Messages[0].Header.Start.Offset
+
+	var block strings.Builder
+	fmt.Fprintf(&block, "%s%s\n", summaryStartMarker, summary.Hash)
+	for _, line := range strings.Split(summary.Text, "\n") {
+		fmt.Fprintf(&block, "%s\n", strings.TrimRight(string(TokenKind_Comment)+" "+line, " "))
+	}
+	fmt.Fprintf(&block, "%s\n", summaryEndMarker)
+
+	return src[:insert] + block.String() + src[insert:], nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendMessageWithSummary(t *testing.T) {
+	src := "+++\nmodel = 'llama3'\n+++\n>>> summary 0123\n>>> old\n>>> end summary\n# user\nhi\n"
+	filename := filepath.Join(t.TempDir(), "chat.md")
+	assert.NoError(t, os.WriteFile(filename, []byte(src), 0600))
+
+	summary := &cachedSummary{Hash: "abcd", Text: "first line\n\n```go\nx := 1\n```"}
+	assert.NoError(t, appendMessage(filename, Message{Role: "assistant", Content: "hello"}, summary))
+
+	contents, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "+++\nmodel = 'llama3'\n+++\n"+
+		">>> summary abcd\n>>> first line\n>>>\n>>> ```go\n>>> x := 1\n>>> ```\n>>> end summary\n"+
+		"# user\nhi\n\n# assistant\nhello\n\n# user\n\n", string(contents))
+
+	doc := parseDocument(string(contents))
+	summaries := findSummaries(string(contents), doc)
+	if assert.Len(t, summaries, 1) {
+		assert.Equal(t, "abcd", summaries[0].Hash)
+		assert.Equal(t, "first line\n\n```go\nx := 1\n```", summaries[0].Text)
+	}
+	// the block is not part of any message
+	assert.Equal(t, "hi", doc.Messages[0].Content)
+
+	_, err = insertSummary("no messages\n", summary)
+	assert.EqualError(t, err, "the conversation has no messages")
+
+	info, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// the file is replaced by a temporary one, which is not left behind
+	entries, err := os.ReadDir(filepath.Dir(filename))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestFindSummariesIgnoresUnterminatedBlocks(t *testing.T) {
+	src := ">>> summary 0123\n>>> cut\n# user\nhi\n>>> end summary\n"
+	assert.Empty(t, findSummaries(src, parseDocument(src)))
+}
+
+func TestSummarizeUsesCache(t *testing.T) {
+	dropped := []Message{{Role: "user", Content: "first question"}, {Role: "assistant", Content: "first answer"}}
+	src := ">>> summary " + hashMessages(dropped) + "\n>>> cached\n>>> end summary\n# user\nfirst question\n"
+
+	// no provider is configured, so only the cache can answer
+	s := &summarizer{config: &configFile{}, maxTokens: 100}
+	summary, isNew, err := s.summarize(context.Background(), "chat.md", src, parseDocument(src), dropped)
+	assert.NoError(t, err)
+	assert.Equal(t, "cached", summary.Text)
+	assert.False(t, isNew)
+
+	dropped[1].Content = "edited answer"
+	_, _, err = s.summarize(context.Background(), "chat.md", src, parseDocument(src), dropped)
+	assert.ErrorContains(t, err, "No provider configured")
+}
+
+func TestChatSummarizesDroppedMessages(t *testing.T) {
+	config, received := newOllamaConfig(t)
+
+	conversation := `---
+context:
+  strategy: messages
+  max_messages: 1
+  summarize: true
+  summary_model: tiny
+---
+# system
+Be brief.
+
+# user
+first question
+
+# assistant
+first answer
+
+# user
+second question
+`
+	filename := filepath.Join(t.TempDir(), "chat.md")
+	assert.NoError(t, os.WriteFile(filename, []byte(conversation), 0644))
+
+	code, _, stderr := runSira(t, "", "--config", config, filename)
+	assert.Equal(t, exitOK, code, stderr)
+
+	if assert.Len(t, *received, 2) {
+		summary := (*received)[0]
+		assert.Equal(t, "tiny", summary.Model)
+		assert.Equal(t, "user:\nfirst question\n\nassistant:\nfirst answer", summary.Messages[1].Content)
+
+		assert.Equal(t, "llama2", (*received)[1].Model)
+		assert.Equal(t, []ollamaMessage{
+			{Role: "system", Content: "Be brief."},
+			{Role: "system", Content: summaryIntro + "hello"},
+			{Role: "user", Content: "second question"},
+		}, (*received)[1].Messages)
+	}
+
+	contents, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	hash := hashMessages([]Message{{Role: "user", Content: "first question"}, {Role: "assistant", Content: "first answer"}})
+	assert.True(t, strings.Contains(string(contents), "---\n>>> summary "+hash+"\n>>> hello\n>>> end summary\n# system\n"), string(contents))
+	assert.True(t, strings.HasSuffix(string(contents), "second question\n\n# assistant\nhello\n\n# user\n\n"), string(contents))
+}
+
+func TestChatFailedKeepsSummaryOut(t *testing.T) {
+	config, received := newOllamaConfig(t)
+	contents, err := os.ReadFile(config)
+	assert.NoError(t, err)
+	// nothing listens on the mistral endpoint, so only the summary succeeds
+	assert.NoError(t, os.WriteFile(config, append(contents, "\n[mistral]\nbase_url = 'http://127.0.0.1:1'\nmodel = 'mistral-tiny'\n"...), 0600))
+
+	conversation := `---
+provider: mistral
+context:
+  strategy: messages
+  max_messages: 1
+  summarize: true
+  summary_provider: ollama
+---
+# user
+first question
+
+# assistant
+first answer
+
+# user
+second question
+`
+	filename := filepath.Join(t.TempDir(), "chat.md")
+	assert.NoError(t, os.WriteFile(filename, []byte(conversation), 0644))
+
+	code, _, _ := runSira(t, "", "--config", config, filename)
+	assert.Equal(t, exitError, code)
+	assert.Len(t, *received, 1)
+
+	after, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, conversation, string(after))
+}
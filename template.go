@@ -0,0 +1,717 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The template language of conversation files. A tag is only recognized when
+// its opening brace is followed by a letter or an underscore and it ends on
+// the same line, so json and most code snippets are left alone:
+//
+//	{name}                       the value of the name param
+//	{user.name}                  a field of a table param
+//	{name|anonymous}             a default, used when name is undefined
+//	{name|"quoted, with } too"}
+//	{if name}...{else}...{end}   name is defined and not false, 0, "" or empty
+//	{if not name}...{end}
+//	{for item in items}...{end}
+//
+// A backslash before a tag, like \{name}, writes it literally.
+
+// TemplateError is an error in a template, like an undefined placeholder.
+type TemplateError struct {
+	Filename string
+	Pos      Pos
+	Msg      string
+}
+
+func (e *TemplateError) Error() string {
+	if e.Filename != "" {
+		return fmt.Sprintf("%s:%v: %s", e.Filename, e.Pos, e.Msg)
+	}
+	return fmt.Sprintf("%v: %s", e.Pos, e.Msg)
+}
+
+// templateErrorAt returns an error at offset, mapped to a file position by
+// the caller.
+func templateErrorAt(offset int, format string, args ...any) *TemplateError {
+	return &TemplateError{Pos: Pos{Offset: offset}, Msg: fmt.Sprintf(format, args...)}
+}
+
+type templateTagKind uint8
+
+const (
+	templateTag_Value templateTagKind = iota
+	templateTag_If
+	templateTag_Else
+	templateTag_End
+	templateTag_For
+)
+
+type templateTag struct {
+	kind     templateTagKind
+	offset   int
+	path     []string
+	negate   bool
+	variable string
+	fallback *string
+}
+
+type templateNode interface{}
+
+type (
+	templateText  string
+	templateValue struct {
+		offset   int
+		path     []string
+		fallback *string
+	}
+	templateIf struct {
+		offset    int
+		path      []string
+		negate    bool
+		then      []templateNode
+		otherwise []templateNode
+	}
+	templateFor struct {
+		offset   int
+		variable string
+		path     []string
+		body     []templateNode
+	}
+)
+
+// promptTemplate is a compiled template.
+type promptTemplate struct {
+	nodes []templateNode
+}
+
+// compileTemplate parses src. Error offsets are relative to src. The code
+// of src, fenced blocks and inline spans, is kept as is.
+func compileTemplate(src string) (*promptTemplate, error) {
+	p := &templateParser{src: src, code: codeRanges(src)}
+
+	nodes, stop, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	if stop != nil {
+		return nil, templateErrorAt(stop.offset, "unexpected %s", stop)
+	}
+
+	return &promptTemplate{nodes: nodes}, nil
+}
+
+func (tag *templateTag) String() string {
+	switch tag.kind {
+	case templateTag_Else:
+		return "{else}"
+	case templateTag_End:
+		return "{end}"
+	case templateTag_If:
+		return "{if}"
+	case templateTag_For:
+		return "{for}"
+	}
+	return "{" + strings.Join(tag.path, ".") + "}"
+}
+
+type templateParser struct {
+	src  string
+	pos  int
+	code []codeRange
+}
+
+// codeRange is the range src[start:end] of a code block or span.
+type codeRange struct {
+	start, end int
+}
+
+// codeRanges returns the fenced code blocks and inline code spans of src, in
+// order. A code block runs to the end of src when it is never closed, and an
+// inline span ends on the line it starts with, at the next run of as many
+// backticks.
+func codeRanges(src string) []codeRange {
+	var ranges []codeRange
+	fence, fenceStart := "", 0
+
+	for offset := 0; offset < len(src); {
+		end := strings.IndexByte(src[offset:], '\n') + offset + 1
+		if end == offset {
+			end = len(src)
+		}
+		line := strings.TrimSuffix(src[offset:end], "\n")
+
+		switch {
+		case fence != "":
+			if isClosingFence(line, fence) {
+				ranges = append(ranges, codeRange{fenceStart, end})
+				fence = ""
+			}
+		default:
+			if opening, ok := openingFence(line); ok {
+				fence, fenceStart = opening, offset
+				break
+			}
+			for _, span := range codeSpans(line) {
+				ranges = append(ranges, codeRange{offset + span.start, offset + span.end})
+			}
+		}
+
+		offset = end
+	}
+	if fence != "" {
+		ranges = append(ranges, codeRange{fenceStart, len(src)})
+	}
+
+	return ranges
+}
+
+// codeSpans returns the inline code spans of line.
+func codeSpans(line string) []codeRange {
+	var spans []codeRange
+	for i := 0; i < len(line); {
+		if line[i] != '`' {
+			i++
+			continue
+		}
+
+		n := backtickRun(line, i)
+		closing := -1
+		for j := i + n; j < len(line); {
+			if line[j] != '`' {
+				j++
+				continue
+			}
+			m := backtickRun(line, j)
+			if m == n {
+				closing = j
+				break
+			}
+			j += m
+		}
+		if closing < 0 {
+			i += n
+			continue
+		}
+
+		spans = append(spans, codeRange{i, closing + n})
+		i = closing + n
+	}
+
+	return spans
+}
+
+// backtickRun returns the number of backticks starting at s[i].
+func backtickRun(s string, i int) int {
+	n := 0
+	for i+n < len(s) && s[i+n] == '`' {
+		n++
+	}
+	return n
+}
+
+// skipCode returns the end of the code range holding p.pos, or -1 when p.pos
+// is not in code.
+func (p *templateParser) skipCode() int {
+	for len(p.code) > 0 && p.code[0].end <= p.pos {
+		p.code = p.code[1:]
+	}
+	if len(p.code) > 0 && p.code[0].start <= p.pos {
+		return p.code[0].end
+	}
+	return -1
+}
+
+// parse parses nodes until an {else} or {end} tag, returned as stop, or the
+// end of the source.
+func (p *templateParser) parse() (nodes []templateNode, stop *templateTag, err error) {
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			nodes = append(nodes, templateText(text.String()))
+			text.Reset()
+		}
+	}
+
+	for p.pos < len(p.src) {
+		if end := p.skipCode(); end >= 0 {
+			text.WriteString(p.src[p.pos:end])
+			p.pos = end
+			continue
+		}
+
+		c := p.src[p.pos]
+
+		if c == '\\' && p.pos+1 < len(p.src) && p.src[p.pos+1] == '{' {
+			if tag, _, err := scanTag(p.src, p.pos+1); tag != nil || err != nil {
+				text.WriteByte('{')
+				p.pos += 2
+				continue
+			}
+		}
+
+		if c != '{' {
+			text.WriteByte(c)
+			p.pos++
+			continue
+		}
+
+		tag, end, err := scanTag(p.src, p.pos)
+		if err != nil {
+			return nil, nil, err
+		}
+		if tag == nil {
+			text.WriteByte(c)
+			p.pos++
+			continue
+		}
+		p.pos = end
+		flush()
+
+		switch tag.kind {
+		case templateTag_Value:
+			nodes = append(nodes, &templateValue{offset: tag.offset, path: tag.path, fallback: tag.fallback})
+
+		case templateTag_Else, templateTag_End:
+			return nodes, tag, nil
+
+		case templateTag_If:
+			node := &templateIf{offset: tag.offset, path: tag.path, negate: tag.negate}
+
+			var stop *templateTag
+			node.then, stop, err = p.parse()
+			if err != nil {
+				return nil, nil, err
+			}
+			if stop != nil && stop.kind == templateTag_Else {
+				node.otherwise, stop, err = p.parse()
+				if err != nil {
+					return nil, nil, err
+				}
+				if stop != nil && stop.kind == templateTag_Else {
+					return nil, nil, templateErrorAt(stop.offset, "unexpected {else}, {if} already has one")
+				}
+			}
+			if stop == nil {
+				return nil, nil, templateErrorAt(tag.offset, "{if} is never closed with {end}")
+			}
+			nodes = append(nodes, node)
+
+		case templateTag_For:
+			node := &templateFor{offset: tag.offset, variable: tag.variable, path: tag.path}
+
+			var stop *templateTag
+			node.body, stop, err = p.parse()
+			if err != nil {
+				return nil, nil, err
+			}
+			if stop == nil {
+				return nil, nil, templateErrorAt(tag.offset, "{for} is never closed with {end}")
+			}
+			if stop.kind == templateTag_Else {
+				return nil, nil, templateErrorAt(stop.offset, "unexpected {else} in {for}")
+			}
+			nodes = append(nodes, node)
+		}
+	}
+
+	flush()
+	return nodes, nil, nil
+}
+
+// scanTag reads the tag starting with the brace at src[start]. It returns a
+// nil tag when the text is not a tag, and an error when it is a tag with a
+// malformed default.
+func scanTag(src string, start int) (*templateTag, int, error) {
+	if start+1 >= len(src) || !isIdentStart(src[start+1]) {
+		return nil, 0, nil
+	}
+
+	// find the closing brace on the same line, skipping quoted defaults
+	end := -1
+	quoted := false
+	for i := start + 1; i < len(src) && src[i] != '\n'; i++ {
+		switch {
+		case quoted && src[i] == '\\':
+			i++
+		case src[i] == '"':
+			quoted = !quoted
+		case !quoted && src[i] == '}':
+			end = i
+		}
+		if end >= 0 {
+			break
+		}
+	}
+	if end < 0 {
+		return nil, 0, nil
+	}
+
+	tag, err := parseTag(src[start+1:end], start)
+	return tag, end + 1, err
+}
+
+// parseTag parses the content of a tag. Content starting with a keyword but
+// not following its grammar, like {for example, a cat}, is not a tag.
+func parseTag(content string, offset int) (*templateTag, error) {
+	fields := strings.Fields(content)
+	tag := &templateTag{offset: offset}
+
+	switch fields[0] {
+	case "if":
+		tag.kind = templateTag_If
+		if len(fields) == 3 && fields[1] == "not" {
+			tag.negate = true
+			fields = fields[1:]
+		}
+		if len(fields) != 2 || !isValidPath(fields[1]) {
+			return nil, nil
+		}
+		tag.path = strings.Split(fields[1], ".")
+		return tag, nil
+
+	case "else", "end":
+		tag.kind = templateTag_Else
+		if fields[0] == "end" {
+			tag.kind = templateTag_End
+		}
+		if len(fields) != 1 {
+			return nil, nil
+		}
+		return tag, nil
+
+	case "for":
+		tag.kind = templateTag_For
+		if len(fields) != 4 || !isValidPath(fields[1]) || strings.Contains(fields[1], ".") ||
+			fields[2] != "in" || !isValidPath(fields[3]) {
+			return nil, nil
+		}
+		tag.variable = fields[1]
+		tag.path = strings.Split(fields[3], ".")
+		return tag, nil
+	}
+
+	name, fallback, hasFallback := strings.Cut(content, "|")
+	name = strings.TrimSpace(name)
+	if !isValidPath(name) {
+		return nil, nil
+	}
+	tag.path = strings.Split(name, ".")
+
+	if hasFallback {
+		fallback = strings.TrimSpace(fallback)
+		if strings.HasPrefix(fallback, `"`) {
+			unquoted, err := strconv.Unquote(fallback)
+			if err != nil {
+				return nil, templateErrorAt(offset, "invalid default %s", fallback)
+			}
+			fallback = unquoted
+		}
+		tag.fallback = &fallback
+	}
+
+	return tag, nil
+}
+
+// escapeTemplate escapes the tags of text, so it renders as is. Its code is
+// never compiled, so it is left untouched.
+func escapeTemplate(text string) string {
+	var escaped strings.Builder
+	code := codeRanges(text)
+	for i := 0; i < len(text); i++ {
+		for len(code) > 0 && code[0].end <= i {
+			code = code[1:]
+		}
+		if len(code) > 0 && code[0].start <= i {
+			escaped.WriteString(text[i:code[0].end])
+			i = code[0].end - 1
+			continue
+		}
+
+		if text[i] == '{' {
+			if tag, _, err := scanTag(text, i); tag != nil || err != nil {
+				escaped.WriteByte('\\')
+			}
+		}
+		escaped.WriteByte(text[i])
+	}
+
+	return escaped.String()
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// isValidPath reports whether path is a dot separated list of names, like
+// "user.name". Names can contain dashes, like toml bare keys.
+func isValidPath(path string) bool {
+	for _, name := range strings.Split(path, ".") {
+		if name == "" || !isIdentStart(name[0]) {
+			return false
+		}
+		for i := 1; i < len(name); i++ {
+			c := name[i]
+			if !isIdentStart(c) && c != '-' && (c < '0' || c > '9') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// params returns the names of the params used by the template, loop
+// variables excluded, and the ones that are required: those rendered without
+// a default or looped over.
+func (t *promptTemplate) params() (used, required []string) {
+	seenUsed := make(map[string]bool)
+	seenRequired := make(map[string]bool)
+
+	use := func(path []string, locals map[string]bool, isRequired bool) {
+		name := path[0]
+		if locals[name] {
+			return
+		}
+		if !seenUsed[name] {
+			seenUsed[name] = true
+			used = append(used, name)
+		}
+		if isRequired && !seenRequired[name] {
+			seenRequired[name] = true
+			required = append(required, name)
+		}
+	}
+
+	var walk func(nodes []templateNode, locals map[string]bool)
+	walk = func(nodes []templateNode, locals map[string]bool) {
+		for _, node := range nodes {
+			switch node := node.(type) {
+			case *templateValue:
+				use(node.path, locals, node.fallback == nil)
+			case *templateIf:
+				use(node.path, locals, false)
+				walk(node.then, locals)
+				walk(node.otherwise, locals)
+			case *templateFor:
+				use(node.path, locals, true)
+				inner := map[string]bool{node.variable: true}
+				for name := range locals {
+					inner[name] = true
+				}
+				walk(node.body, inner)
+			}
+		}
+	}
+	walk(t.nodes, nil)
+
+	return used, required
+}
+
+// templateParams returns the params used and required by the templates of
+// doc, see promptTemplate.params. Messages that don't compile are skipped.
+func (doc *Document) templateParams() (used, required []string) {
+	seen := make(map[string]bool)
+	seenRequired := make(map[string]bool)
+
+	for _, node := range doc.Messages {
+		if node.Role == "assistant" || node.Attrs.Skip {
+			continue
+		}
+		tmpl, err := compileTemplate(node.Content)
+		if err != nil {
+			continue
+		}
+
+		messageUsed, messageRequired := tmpl.params()
+		for _, name := range messageUsed {
+			if !seen[name] {
+				seen[name] = true
+				used = append(used, name)
+			}
+		}
+		for _, name := range messageRequired {
+			if !seenRequired[name] {
+				seenRequired[name] = true
+				required = append(required, name)
+			}
+		}
+	}
+
+	return used, required
+}
+
+// render executes the template. Rendering goes on after an error, so all of
+// them are reported at once.
+func (t *promptTemplate) render(params map[string]any) (string, []*TemplateError) {
+	r := &templateRenderer{params: params}
+	r.render(t.nodes)
+	return r.out.String(), r.errs
+}
+
+type templateLocal struct {
+	name  string
+	value any
+}
+
+type templateRenderer struct {
+	params map[string]any
+	locals []templateLocal
+	out    strings.Builder
+	errs   []*TemplateError
+}
+
+func (r *templateRenderer) render(nodes []templateNode) {
+	for _, node := range nodes {
+		switch node := node.(type) {
+		case templateText:
+			r.out.WriteString(string(node))
+
+		case *templateValue:
+			value, ok := r.lookup(node.path)
+			if !ok && node.fallback != nil {
+				r.out.WriteString(*node.fallback)
+				continue
+			}
+			if !ok {
+				r.undefined(node.offset, node.path)
+				continue
+			}
+			text, err := formatTemplateValue(value)
+			if err != nil {
+				r.errs = append(r.errs, templateErrorAt(node.offset, "cannot render {%s}: %v", strings.Join(node.path, "."), err))
+				continue
+			}
+			r.out.WriteString(text)
+
+		case *templateIf:
+			value, _ := r.lookup(node.path)
+			if isTruthy(value) != node.negate {
+				r.render(node.then)
+			} else {
+				r.render(node.otherwise)
+			}
+
+		case *templateFor:
+			value, ok := r.lookup(node.path)
+			if !ok {
+				r.undefined(node.offset, node.path)
+				continue
+			}
+			items := reflect.ValueOf(value)
+			if items.Kind() != reflect.Slice && items.Kind() != reflect.Array {
+				r.errs = append(r.errs, templateErrorAt(node.offset, "cannot loop over {%s}, a %T is not a list", strings.Join(node.path, "."), value))
+				continue
+			}
+			for i := 0; i < items.Len(); i++ {
+				r.locals = append(r.locals, templateLocal{name: node.variable, value: items.Index(i).Interface()})
+				r.render(node.body)
+				r.locals = r.locals[:len(r.locals)-1]
+			}
+		}
+	}
+}
+
+func (r *templateRenderer) undefined(offset int, path []string) {
+	r.errs = append(r.errs, templateErrorAt(offset, "undefined placeholder {%s}", strings.Join(path, ".")))
+}
+
+// lookup resolves a path, loop variables first.
+func (r *templateRenderer) lookup(path []string) (any, bool) {
+	var value any
+	found := false
+	for i := len(r.locals) - 1; i >= 0; i-- {
+		if r.locals[i].name == path[0] {
+			value, found = r.locals[i].value, true
+			break
+		}
+	}
+	if !found {
+		value, found = r.params[path[0]]
+	}
+
+	for _, field := range path[1:] {
+		if !found {
+			break
+		}
+		table := reflect.ValueOf(value)
+		if table.Kind() != reflect.Map || table.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		v := table.MapIndex(reflect.ValueOf(field).Convert(table.Type().Key()))
+		if !v.IsValid() {
+			return nil, false
+		}
+		value = v.Interface()
+	}
+
+	return value, found
+}
+
+// formatTemplateValue renders a param as text. Lists are joined with commas,
+// tables can't be rendered as a whole.
+func formatTemplateValue(value any) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case float32:
+		return strconv.FormatFloat(float64(value), 'f', -1, 32), nil
+	case time.Time:
+		return value.Format(time.RFC3339), nil
+	case fmt.Stringer:
+		return value.String(), nil
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return fmt.Sprint(value), nil
+
+	case reflect.Slice, reflect.Array:
+		items := make([]string, v.Len())
+		for i := range items {
+			item, err := formatTemplateValue(v.Index(i).Interface())
+			if err != nil {
+				return "", err
+			}
+			items[i] = item
+		}
+		return strings.Join(items, ", "), nil
+
+	case reflect.Map:
+		return "", fmt.Errorf("a table can't be rendered, use one of its fields")
+	}
+
+	return "", fmt.Errorf("unsupported type %T", value)
+}
+
+// isTruthy reports whether a value selects the {if} branch: anything but
+// undefined, false, zero and empty.
+func isTruthy(value any) bool {
+	if value == nil {
+		return false
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return v.Len() > 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() != 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() != 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() != 0
+	}
+
+	return true
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/stretchr/testify/assert"
+)
+
+func renderString(t *testing.T, src string, params map[string]any) (string, error) {
+	t.Helper()
+
+	tmpl, err := compileTemplate(src)
+	if err != nil {
+		return "", err
+	}
+
+	out, errs := tmpl.render(params)
+	if len(errs) > 0 {
+		return "", errs[0]
+	}
+	return out, nil
+}
+
+func TestRenderTemplate(t *testing.T) {
+	var params map[string]any
+	_, err := toml.Decode(`
+topic = "rainbows"
+lines = 3
+temperature = 0.7
+rhyme = false
+tags = ["short", "funny"]
+empty = []
+
+[author]
+name = "Basho"
+
+[[examples]]
+title = "old pond"
+
+[[examples]]
+title = "frog"
+`, &params)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{"string", "about {topic}.", "about rainbows."},
+		{"typed values", "{lines} lines, {temperature}, rhyme {rhyme}", "3 lines, 0.7, rhyme false"},
+		{"list", "tags: {tags}", "tags: short, funny"},
+		{"table field", "in the style of {author.name}", "in the style of Basho"},
+		{"default", "for {audience|kids} and {topic|nothing}", "for kids and rainbows"},
+		{"quoted default", `{audience|"grown ups, {really}"}`, "grown ups, {really}"},
+		{"if", "{if rhyme}rhyme{else}don't rhyme{end}, {if tags}tagged{end}", "don't rhyme, tagged"},
+		{"if not", "{if not empty}no examples{end}{if not missing}, nothing missing{end}", "no examples, nothing missing"},
+		{"for", "{for tag in tags}#{tag} {end}", "#short #funny "},
+		{"nested for", "{for e in examples}{if e.title}- {e.title} by {author.name}\n{end}{end}", "- old pond by Basho\n- frog by Basho\n"},
+		{"escape", `\{topic} is {topic}`, "{topic} is rainbows"},
+		{"not tags", `{"json": true} { topic } {1} {topic is nice} \n`, `{"json": true} { topic } {1} {topic is nice} \n`},
+		{"code span", "`{name}` and ``a `{b}` c`` are {topic}", "`{name}` and ``a `{b}` c`` are rainbows"},
+		{"unclosed code span", "`{topic}", "`rainbows"},
+		{"code block", "{topic}\n```python\nprint(f\"hello {name}\")\n```\n{topic}", "rainbows\n```python\nprint(f\"hello {name}\")\n```\nrainbows"},
+		{"keyword prose", "{for example, a cat} and {end of story}, {if a b}", "{for example, a cat} and {end of story}, {if a b}"},
+		{"keyword code", "function f() {if (a) return 1} {else if}", "function f() {if (a) return 1} {else if}"},
+		{"unclosed code block", "~~~\n{end}", "~~~\n{end}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := renderString(t, tt.template, params)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, out)
+		})
+	}
+}
+
+func TestRenderTemplateErrors(t *testing.T) {
+	params := map[string]any{
+		"topic":  "rainbows",
+		"author": map[string]any{"name": "Basho"},
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{"undefined", "a\nb {topicc}", "0:0: undefined placeholder {topicc}"},
+		{"undefined field", "{author.age}", "0:0: undefined placeholder {author.age}"},
+		{"table", "{author}", "0:0: cannot render {author}: a table can't be rendered, use one of its fields"},
+		{"loop over string", "{for c in topic}{c}{end}", "0:0: cannot loop over {topic}, a string is not a list"},
+		{"unclosed if", "{if topic}yes", "0:0: {if} is never closed with {end}"},
+		{"unclosed for", "{for t in topics}", "0:0: {for} is never closed with {end}"},
+		{"stray end", "{topic}{end}", "0:0: unexpected {end}"},
+		{"double else", "{if topic}a{else}b{else}c{end}", "0:0: unexpected {else}, {if} already has one"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := renderString(t, tt.template, params)
+			assert.EqualError(t, err, tt.expected)
+		})
+	}
+}
+
+func TestParseTemplateErrorPositions(t *testing.T) {
+	template := `# system
+>>> a comment
+  Write a haiku about your favorite {topicc}.
+>>> another one
+In {lang}, {if short}short{end}.
+
+# assistant
+Sure, {anything} goes here.
+
+# user
+{for x in xs}
+`
+
+	_, err := parseTemplate(template, nil)
+	assert.EqualError(t, err, "3:37: undefined placeholder {topicc}\n5:4: undefined placeholder {lang}\n11:1: {for} is never closed with {end}")
+
+	_, err = renderDocument(parseDocument(template), template, "haiku.md", map[string]any{"topic": "food"})
+	assert.ErrorContains(t, err, "haiku.md:3:37: undefined placeholder {topicc}")
+}
+
+func TestRenderDocumentCode(t *testing.T) {
+	src := "# user\nFix this {lang} code:\n\n```python\nname = input()\nprint(f\"hello {name}\")\n```\n\nkeep `{name}` as is.\n"
+
+	messages, err := renderDocument(parseDocument(src), src, "code.md", map[string]any{"lang": "python"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Fix this python code:\n\n```python\nname = input()\nprint(f\"hello {name}\")\n```\n\nkeep `{name}` as is.", messages[0].Content)
+
+	// escaping leaves the code alone, as it is never compiled
+	assert.Equal(t, "\\{lang} `{lang}`\n```\n{lang}\n```\n", escapeTemplate("{lang} `{lang}`\n```\n{lang}\n```\n"))
+}
+
+func TestParseTemplateUnusedParam(t *testing.T) {
+	_, err := parseTemplate("# user\n{if short}Be brief.{end}", map[string]any{"short": true, "topic": "food"})
+	assert.EqualError(t, err, `Could not find parameter "topic" in template`)
+}
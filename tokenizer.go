@@ -0,0 +1,192 @@
+package main
+
+import (
+	"compress/gzip"
+	"embed"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"unicode/utf8"
+)
+
+// tokenizer counts the tokens of a text for a model.
+type tokenizer interface {
+	// Name is the name of the encoding, or "estimate" for approximations.
+	Name() string
+	CountTokens(text string) int
+}
+
+// Every message costs a few tokens on top of its content, for the role and
+// the delimiters, and the answer is primed with a few more. These are the
+// numbers of the openai chat format, close enough for the other providers.
+const (
+	tokensPerMessage = 4
+	tokensPerReply   = 3
+)
+
+// approxTokenizer estimates the tokens of a text from its length.
+type approxTokenizer struct {
+	charsPerToken float64
+}
+
+func (approxTokenizer) Name() string {
+	return "estimate"
+}
+
+func (t approxTokenizer) CountTokens(text string) int {
+	chars := utf8.RuneCountInString(text)
+	if chars == 0 {
+		return 0
+	}
+	return int(float64(chars)/t.charsPerToken) + 1
+}
+
+var (
+	// about 4 characters per token is the usual ratio for english text
+	defaultApproxTokenizer = approxTokenizer{charsPerToken: 4}
+	// the 32k vocabulary of mistral models makes about 15% more tokens than
+	// cl100k_base for english text
+	mistralApproxTokenizer = approxTokenizer{charsPerToken: 3.5}
+)
+
+// The openai tables, gzipped to halve their size.
+//go:generate sh -c "curl -sSf https://openaipublic.blob.core.windows.net/encodings/cl100k_base.tiktoken | gzip -9n > bpe/cl100k_base.tiktoken.gz"
+//go:generate sh -c "curl -sSf https://openaipublic.blob.core.windows.net/encodings/o200k_base.tiktoken | gzip -9n > bpe/o200k_base.tiktoken.gz"
+
+// bpeTables holds the tiktoken files of the encodings, as
+// bpe/<name>.tiktoken.gz.
+//
+//go:embed bpe/*.tiktoken.gz
+var bpeTables embed.FS
+
+var (
+	encodingsMu sync.Mutex
+	encodings   = map[string]*bpeEncoding{}
+)
+
+// loadEncoding returns an openai encoding from the tables embedded in the
+// binary. It returns nil when the encoding has no table.
+func loadEncoding(name string) *bpeEncoding {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+
+	if encoding, ok := encodings[name]; ok {
+		return encoding
+	}
+
+	var encoding *bpeEncoding
+	if ranks, err := readRanks(name); err == nil && len(ranks) > 0 {
+		encoding = &bpeEncoding{name: name, pattern: cl100kPattern, ranks: ranks}
+		if name == "o200k_base" {
+			encoding.pattern = o200kPattern
+		}
+	} else {
+		verboseLog.Printf("tokens: the %s tables are not available, counts are estimated", name)
+	}
+
+	encodings[name] = encoding
+	return encoding
+}
+
+// readRanks reads the embedded table of an encoding.
+func readRanks(name string) (map[string]int, error) {
+	f, err := bpeTables.Open("bpe/" + name + ".tiktoken.gz")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	return parseRanks(r)
+}
+
+// tokenizerFor returns the tokenizer of a model: the exact encoding of
+// openai models when available, an estimate otherwise.
+func tokenizerFor(model string) tokenizer {
+	var encoding string
+	switch {
+	case strings.HasPrefix(model, "gpt-4o"), strings.HasPrefix(model, "o1"):
+		encoding = "o200k_base"
+	case strings.HasPrefix(model, "gpt-4"), strings.HasPrefix(model, "gpt-3.5"), strings.HasPrefix(model, "text-embedding-3"):
+		encoding = "cl100k_base"
+	case strings.Contains(model, "mistral"), strings.Contains(model, "mixtral"), strings.HasPrefix(model, "codestral"):
+		return mistralApproxTokenizer
+	default:
+		return defaultApproxTokenizer
+	}
+
+	if bpe := loadEncoding(encoding); bpe != nil {
+		return bpe
+	}
+	return defaultApproxTokenizer
+}
+
+// countMessageTokens returns the tokens of messages as sent in a request,
+// without the reply priming.
+func countMessageTokens(tk tokenizer, message Message) int {
+	return tk.CountTokens(message.Content) + tokensPerMessage
+}
+
+// printTokenReport prints the tokens of each message of doc, rendered as
+// messages, followed by the total, what is left of the context window and
+// the input cost of sending them.
+func printTokenReport(w io.Writer, doc *Document, messages []Message, window *contextWindow) error {
+	truncated := window.truncate(messages)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "line\trole\ttokens")
+	total := tokensPerReply
+	i := 0
+	for _, node := range doc.Messages {
+		if node.Attrs.Skip {
+			fmt.Fprintf(tw, "%d\t%s\t-\tskipped\n", node.Header.Start.Line, node.Role)
+			continue
+		}
+		message := messages[i]
+		tokens := countMessageTokens(window.tokenizer, message)
+		total += tokens
+
+		fmt.Fprintf(tw, "%d\t%s\t%d", node.Header.Start.Line, message.Role, tokens)
+		switch {
+		case !truncated.Keep[i]:
+			fmt.Fprint(tw, "\tdropped")
+		case message.Pinned:
+			fmt.Fprint(tw, "\tpinned")
+		}
+		fmt.Fprintln(tw)
+		i++
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(w)
+
+	encoding := window.tokenizer.Name()
+	if encoding == "estimate" {
+		encoding = "estimated"
+	}
+	sent := truncated.Tokens
+	if len(truncated.Dropped) > 0 {
+		fmt.Fprintf(w, "total:   %d tokens (%s), %d sent\n", total, encoding, sent)
+	} else {
+		fmt.Fprintf(w, "total:   %d tokens (%s)\n", total, encoding)
+	}
+
+	if window.contextLength > 0 {
+		fmt.Fprintf(w, "context: %d tokens, %d left\n", window.contextLength, window.contextLength-sent)
+	} else {
+		fmt.Fprintf(w, "context: unknown for model %q\n", window.model)
+	}
+
+	if info, ok := lookupModel(window.model); ok && info.Pricing != nil {
+		_, err := fmt.Fprintf(w, "cost:    $%.6f input\n", info.Pricing.Cost(sent, 0))
+		return err
+	}
+	_, err := fmt.Fprintf(w, "cost:    unknown for model %q\n", window.model)
+	return err
+}
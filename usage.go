@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// usageConfig is the [usage] section of the config file.
+type usageConfig struct {
+	// Ledger is the path of the usage ledger, defaulting to
+	// $XDG_STATE_HOME/sira/usage.jsonl.
+	Ledger string `toml:"ledger"`
+	// Disabled stops recording requests.
+	Disabled bool `toml:"disabled"`
+}
+
+// usageRecord is a line of the usage ledger, for a single request.
+type usageRecord struct {
+	Time     time.Time `json:"time"`
+	Provider string    `json:"provider"`
+	Model    string    `json:"model"`
+	// File is the absolute path of the conversation.
+	File             string `json:"file"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	// Estimated is set when the provider didn't report the tokens, like an
+	// openai compatible server with stream_usage off, and sira counted them.
+	Estimated bool  `json:"estimated,omitempty"`
+	LatencyMS int64 `json:"latency_ms"`
+	// Cost is in dollars, nil when the price of the model is unknown.
+	Cost *float64 `json:"cost"`
+	// Summary is set for the requests summarizing dropped messages.
+	Summary bool `json:"summary,omitempty"`
+}
+
+func decodeUsageConfig(section map[string]any) (*usageConfig, error) {
+	parsedConfig := new(usageConfig)
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:  parsedConfig,
+		TagName: "toml",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not create decoder: %w", err)
+	}
+
+	if err := decoder.Decode(section); err != nil {
+		return nil, fmt.Errorf("usage: %w", err)
+	}
+
+	return parsedConfig, nil
+}
+
+// usageLedger returns the path of the usage ledger, empty when recording is
+// disabled.
+func (file *configFile) usageLedger() (string, error) {
+	config, err := decodeUsageConfig(file.Section("usage"))
+	if err != nil {
+		return "", err
+	}
+	if config.Disabled {
+		return "", nil
+	}
+	if config.Ledger != "" {
+		return expandHome(config.Ledger)
+	}
+
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "sira", "usage.jsonl"), nil
+}
+
+// expandHome replaces a leading ~/ with the home directory.
+func expandHome(path string) (string, error) {
+	rest, ok := strings.CutPrefix(path, "~/")
+	if !ok {
+		return path, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, rest), nil
+}
+
+// request is a request being sent, to be recorded in the usage ledger once
+// answered.
+type request struct {
+	config   *configFile
+	filename string
+	messages []Message
+	start    time.Time
+	summary  bool
+}
+
+func newRequest(config *configFile, filename string, messages []Message) *request {
+	return &request{config: config, filename: filename, messages: messages, start: time.Now()}
+}
+
+// record appends the usage of the request answered by completion to the
+// ledger. The tokens the provider didn't report are counted by sira.
+func (r *request) record(completion *Completion) error {
+	ledger, err := r.config.usageLedger()
+	if err != nil || ledger == "" {
+		return err
+	}
+
+	record := usageRecord{
+		Time:             r.start.UTC(),
+		PromptTokens:     completion.Usage.PromptTokens,
+		CompletionTokens: completion.Usage.CompletionTokens,
+		LatencyMS:        time.Since(r.start).Milliseconds(),
+		Summary:          r.summary,
+	}
+	if selected, err := r.config.selectedProvider(); err == nil {
+		record.Provider = selected
+		record.Model, _ = r.config.Section(selected)["model"].(string)
+	}
+	if r.filename != "" {
+		if record.File, err = filepath.Abs(r.filename); err != nil {
+			return err
+		}
+	}
+
+	if record.PromptTokens == 0 && record.CompletionTokens == 0 {
+		tk := tokenizerFor(record.Model)
+		record.PromptTokens = tokensPerReply
+		for _, message := range r.messages {
+			record.PromptTokens += countMessageTokens(tk, message)
+		}
+		record.CompletionTokens = tk.CountTokens(completion.Message.Content)
+		record.Estimated = true
+	}
+
+	if info, ok := lookupModel(record.Model); ok && info.Pricing != nil {
+		cost := info.Pricing.Cost(record.PromptTokens, record.CompletionTokens)
+		record.Cost = &cost
+	}
+
+	return appendUsage(ledger, record)
+}
+
+func appendUsage(ledger string, record usageRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ledger), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(ledger, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readUsage reads the records of a ledger. A missing ledger has no records.
+func readUsage(ledger string) ([]usageRecord, error) {
+	f, err := os.Open(ledger)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []usageRecord
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		var record usageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", ledger, line, err)
+		}
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
+
+// The keys usage can be aggregated by.
+var usageGroupings = map[string]func(usageRecord) string{
+	"day":   func(r usageRecord) string { return r.Time.Local().Format("2006-01-02") },
+	"model": func(r usageRecord) string { return r.Provider + "/" + r.Model },
+	"file":  func(r usageRecord) string { return r.File },
+}
+
+// usageTotal sums the usage of a group of records.
+type usageTotal struct {
+	Key              string
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64
+	// UnknownCost counts the requests whose cost is unknown.
+	UnknownCost int
+}
+
+func (t *usageTotal) add(record usageRecord) {
+	t.Requests++
+	t.PromptTokens += record.PromptTokens
+	t.CompletionTokens += record.CompletionTokens
+	if record.Cost != nil {
+		t.Cost += *record.Cost
+	} else {
+		t.UnknownCost++
+	}
+}
+
+func (t *usageTotal) cost() string {
+	if t.UnknownCost == t.Requests {
+		return "?"
+	}
+	cost := fmt.Sprintf("$%.4f", t.Cost)
+	if t.UnknownCost > 0 {
+		cost += "+"
+	}
+	return cost
+}
+
+// aggregateUsage sums records by the given grouping, sorted by key.
+func aggregateUsage(records []usageRecord, by string) []*usageTotal {
+	key := usageGroupings[by]
+
+	totals := make(map[string]*usageTotal)
+	for _, record := range records {
+		k := key(record)
+		if totals[k] == nil {
+			totals[k] = &usageTotal{Key: k}
+		}
+		totals[k].add(record)
+	}
+
+	result := make([]*usageTotal, 0, len(totals))
+	for _, total := range totals {
+		result = append(result, total)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+
+	return result
+}
+
+// printUsageReport prints the usage of records aggregated by day, model or
+// file, and the total. Costs missing some unknown prices end with a +.
+func printUsageReport(w io.Writer, records []usageRecord, by string) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\trequests\tprompt\tcompletion\tcost\n", by)
+
+	total := &usageTotal{Key: "total"}
+	for _, group := range aggregateUsage(records, by) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\n", group.Key, group.Requests, group.PromptTokens, group.CompletionTokens, group.cost())
+	}
+	for _, record := range records {
+		total.add(record)
+	}
+	fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\n", total.Key, total.Requests, total.PromptTokens, total.CompletionTokens, total.cost())
+
+	return tw.Flush()
+}
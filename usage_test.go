@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageReport(t *testing.T) {
+	cost := func(c float64) *float64 { return &c }
+	day := time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)
+	records := []usageRecord{
+		{Time: day, Provider: "openai", Model: "gpt-4", File: "/a.md", PromptTokens: 1000, CompletionTokens: 100, Cost: cost(0.036)},
+		{Time: day, Provider: "ollama", Model: "llama2", File: "/b.md", PromptTokens: 10, CompletionTokens: 5, Cost: cost(0)},
+		{Time: day.AddDate(0, 0, 1), Provider: "openai", Model: "local", File: "/a.md", PromptTokens: 20, CompletionTokens: 2},
+	}
+
+	ledger := filepath.Join(t.TempDir(), "sira", "usage.jsonl")
+	for _, record := range records {
+		assert.NoError(t, appendUsage(ledger, record))
+	}
+	read, err := readUsage(ledger)
+	assert.NoError(t, err)
+	assert.Len(t, read, 3)
+	assert.Equal(t, records[0].Cost, read[0].Cost)
+	assert.Nil(t, read[2].Cost)
+
+	var report strings.Builder
+	assert.NoError(t, printUsageReport(&report, read, "day"))
+	assert.Equal(t, `day         requests  prompt  completion  cost
+2024-05-01  2         1010    105         $0.0360
+2024-05-02  1         20      2           ?
+total       3         1030    107         $0.0360+
+`, report.String())
+
+	report.Reset()
+	assert.NoError(t, printUsageReport(&report, read, "file"))
+	assert.Equal(t, `file   requests  prompt  completion  cost
+/a.md  2         1020    102         $0.0360+
+/b.md  1         10      5           $0.0000
+total  3         1030    107         $0.0360+
+`, report.String())
+
+	missing, err := readUsage(filepath.Join(t.TempDir(), "missing.jsonl"))
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+}
+
+func TestCLIUsageLedger(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	config, _ := newOllamaConfig(t)
+
+	filename := filepath.Join(t.TempDir(), "chat.md")
+	assert.NoError(t, os.WriteFile(filename, []byte("# user\nhi\n"), 0644))
+
+	code, _, stderr := runSira(t, "", "--config", config, filename)
+	assert.Equal(t, exitOK, code, stderr)
+
+	records, err := readUsage(filepath.Join(os.Getenv("XDG_STATE_HOME"), "sira", "usage.jsonl"))
+	assert.NoError(t, err)
+	if assert.Len(t, records, 1) {
+		record := records[0]
+		assert.Equal(t, "ollama", record.Provider)
+		assert.Equal(t, "llama2", record.Model)
+		assert.Equal(t, filename, record.File)
+		// the test server reports no usage
+		assert.True(t, record.Estimated)
+		assert.Equal(t, tokensPerReply+tokensPerMessage+1, record.PromptTokens)
+		assert.Equal(t, 2, record.CompletionTokens)
+		assert.Equal(t, 0.0, *record.Cost)
+	}
+
+	code, stdout, stderr := runSira(t, "", "--config", config, "usage", "model")
+	assert.Equal(t, exitOK, code, stderr)
+	assert.Contains(t, stdout, "ollama/llama2  1         8       2           $0.0000\n")
+
+	code, _, stderr = runSira(t, "", "--config", config, "usage", "week")
+	assert.Equal(t, exitUsage, code)
+	assert.Contains(t, stderr, `unknown grouping "week"`)
+}
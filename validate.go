@@ -0,0 +1,709 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// configProblem is a mistake in the config, like a misspelled key.
+type configProblem struct {
+	// Path is the dotted path of the setting, like openai.max_tokens.
+	Path    string
+	Message string
+	// Origin is where the setting comes from, a file or an environment
+	// variable, and Line its line when it is a file.
+	Origin string
+	Line   int
+}
+
+func (p configProblem) String() string {
+	switch {
+	case p.Line > 0:
+		return fmt.Sprintf("%s:%d: %s: %s", p.Origin, p.Line, p.Path, p.Message)
+	case p.Origin != "":
+		return fmt.Sprintf("%s: %s: %s", p.Origin, p.Path, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+// configError lists the problems of an invalid config.
+type configError struct {
+	problems []configProblem
+}
+
+func (e *configError) Error() string {
+	var msg strings.Builder
+	msg.WriteString("invalid config:")
+	for _, problem := range e.problems {
+		msg.WriteString("\n  " + problem.String())
+	}
+	return msg.String()
+}
+
+// configSchema describes the settings a config table accepts, as the
+// structs the table is decoded into.
+type configSchema struct {
+	tagName string
+	types   []reflect.Type
+	// check validates the settings once they have the right types, for the
+	// constraints spanning several settings.
+	check func(section map[string]any) error
+}
+
+func newConfigSchema(tagName string, targets ...any) *configSchema {
+	schema := &configSchema{tagName: tagName}
+	for _, target := range targets {
+		schema.types = append(schema.types, reflect.TypeOf(target))
+	}
+	return schema
+}
+
+// providerSchemas are the schemas of the sections of each kind of provider.
+var providerSchemas = map[string]*configSchema{}
+
+// registerProviderSchema declares the structs the sections of a provider
+// are decoded into. It is meant to be called from the init function of each
+// provider file, next to registerProvider.
+func registerProviderSchema(name, tagName string, targets ...any) {
+	providerSchemas[name] = newConfigSchema(tagName, targets...)
+}
+
+// sectionSchemas are the schemas of the sections that aren't providers.
+var sectionSchemas = map[string]*configSchema{
+	"context": {
+		tagName: "toml",
+		types:   []reflect.Type{reflect.TypeOf(contextConfig{})},
+		check: func(section map[string]any) error {
+			_, err := decodeContextConfig(section)
+			return err
+		},
+	},
+	"usage": newConfigSchema("toml", usageConfig{}),
+	"http":  newConfigSchema("toml", httpConfig{}),
+}
+
+// settingRange is the range of the numeric settings of the providers.
+type settingRange struct {
+	min, max float64
+	// unbounded is set when there is no max.
+	unbounded bool
+}
+
+// settingRanges are the valid ranges of the numeric settings sharing a name
+// across providers, at any depth of their sections, like the temperature of
+// the ollama options.
+var settingRanges = map[string]settingRange{
+	"temperature":       {min: 0, max: 2},
+	"top_p":             {min: 0, max: 1},
+	"presence_penalty":  {min: -2, max: 2},
+	"frequency_penalty": {min: -2, max: 2},
+	"max_tokens":        {min: 1, unbounded: true},
+	"max_output_tokens": {min: 1, unbounded: true},
+	"top_k":             {min: 1, unbounded: true},
+	"n":                 {min: 1, unbounded: true},
+}
+
+// validate checks the config for unknown keys, values of the wrong type and
+// values out of range, and returns a *configError listing them, located in
+// the config files.
+func (file *configFile) validate() error {
+	var problems []configProblem
+
+	for _, key := range file.unknownKeys {
+		problems = append(problems, configProblem{
+			Path:    key,
+			Message: unknownKeyMessage(key, file.topLevelNames()),
+		})
+	}
+
+	names := make([]string, 0, len(file.sections))
+	for name := range file.sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		problems = append(problems, file.validateSection(name, name, file.sections[name])...)
+	}
+
+	lines := make(map[string]map[string]int)
+	located := problems[:0]
+	for _, problem := range problems {
+		problem.Origin = file.originOf(problem.Path)
+		// the settings of a profile are reported in [profiles]
+		if strings.HasPrefix(problem.Origin, "profile ") {
+			continue
+		}
+		problem.Line = settingLine(lines, problem.Origin, problem.Path)
+		located = append(located, problem)
+	}
+	if len(located) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(located, func(i, j int) bool {
+		if located[i].Origin != located[j].Origin {
+			return located[i].Origin < located[j].Origin
+		}
+		if located[i].Line != located[j].Line {
+			return located[i].Line < located[j].Line
+		}
+		return located[i].Path < located[j].Path
+	})
+	return &configError{problems: located}
+}
+
+// topLevelNames returns the keys and the sections valid at the top level.
+func (file *configFile) topLevelNames() []string {
+	names := append([]string{profilesSection}, topLevelKeys...)
+	for name := range sectionSchemas {
+		names = append(names, name)
+	}
+	return append(names, providerNames()...)
+}
+
+// validateSection checks the section name, at path.
+func (file *configFile) validateSection(path, name string, section map[string]any) []configProblem {
+	if name == profilesSection {
+		return file.validateProfiles(section)
+	}
+	if schema, ok := sectionSchemas[name]; ok {
+		return schema.validate(path, section, nil)
+	}
+
+	kind, ok := file.providerType(name)
+	if !ok {
+		if value, ok := section["type"]; ok {
+			return []configProblem{{
+				Path:    path + ".type",
+				Message: fmt.Sprintf("unknown provider %v, available providers: %v", value, providerNames()),
+			}}
+		}
+
+		message := fmt.Sprintf("unknown section, set its type to one of %v to use it as a provider", providerNames())
+		if closest := closestKey(name, file.topLevelNames()); closest != "" {
+			message = fmt.Sprintf("unknown section, did you mean %s?", closest)
+		}
+		return []configProblem{{Path: path, Message: message}}
+	}
+
+	return validateProviderSettings(path, kind, section, []string{"type"})
+}
+
+// validateProviderSettings checks the settings of a provider of the given
+// kind. extra are the keys accepted on top of the provider ones.
+func validateProviderSettings(path, kind string, settings map[string]any, extra []string) []configProblem {
+	schema, ok := providerSchemas[kind]
+	if !ok {
+		return nil
+	}
+
+	problems := schema.validate(path, settings, extra)
+	walkNumbers(settings, path, func(setting string, value float64) {
+		name := setting[strings.LastIndex(setting, ".")+1:]
+		valid, ok := settingRanges[name]
+		switch {
+		case !ok:
+		case valid.unbounded && value < valid.min:
+			problems = append(problems, configProblem{
+				Path:    setting,
+				Message: fmt.Sprintf("must be at least %v, got %v", valid.min, value),
+			})
+		case !valid.unbounded && (value < valid.min || value > valid.max):
+			problems = append(problems, configProblem{
+				Path:    setting,
+				Message: fmt.Sprintf("must be between %v and %v, got %v", valid.min, valid.max, value),
+			})
+		}
+	})
+
+	return problems
+}
+
+// validateProfiles checks the [profiles] section: each profile holds
+// settings of its provider, sections, and model aliases.
+func (file *configFile) validateProfiles(profiles map[string]any) []configProblem {
+	var problems []configProblem
+
+	for name, value := range profiles {
+		path := profilesSection + "." + name
+		profile, ok := value.(map[string]any)
+		if !ok {
+			problems = append(problems, configProblem{Path: path, Message: fmt.Sprintf("must be a table, got %T", value)})
+			continue
+		}
+
+		provider, _ := file.selectedProvider()
+		if value, ok := profile["provider"]; ok {
+			name, isString := value.(string)
+			_, known := file.providerType(name)
+			switch {
+			case !isString:
+				problems = append(problems, configProblem{Path: path + ".provider", Message: fmt.Sprintf("must be a string, got %T", value)})
+			case !known:
+				problems = append(problems, configProblem{Path: path + ".provider", Message: fmt.Sprintf("unknown provider %q, available providers: %v", name, providerNames())})
+			}
+			provider = name
+		}
+
+		settings := make(map[string]any)
+		for key, value := range profile {
+			table, isTable := value.(map[string]any)
+			switch {
+			case key == "provider":
+			case key == "aliases":
+				problems = append(problems, validateAliases(path+".aliases", value)...)
+			case isTable && file.isSectionName(key):
+				problems = append(problems, file.validateSection(path+"."+key, key, table)...)
+			default:
+				settings[key] = value
+			}
+		}
+
+		if kind, ok := file.providerType(provider); ok {
+			problems = append(problems, validateProviderSettings(path, kind, settings, []string{"provider", "aliases"})...)
+		}
+	}
+
+	return problems
+}
+
+func validateAliases(path string, value any) []configProblem {
+	aliases, ok := value.(map[string]any)
+	if !ok {
+		return []configProblem{{Path: path, Message: fmt.Sprintf("must be a table, got %T", value)}}
+	}
+
+	var problems []configProblem
+	for alias, model := range aliases {
+		if _, ok := model.(string); !ok {
+			problems = append(problems, configProblem{Path: path + "." + alias, Message: fmt.Sprintf("must name a model, got %T", model)})
+		}
+	}
+	return problems
+}
+
+// decodeErrorPattern matches an error of mapstructure, which starts with the
+// quoted name of the setting.
+var decodeErrorPattern = regexp.MustCompile(`^'([^']*)' (.*)$`)
+
+// validate decodes settings into the structs of the schema, reporting the
+// type mismatches, and the keys none of the structs knows. extra are the
+// keys accepted at the top of settings on top of the schema ones.
+func (schema *configSchema) validate(path string, settings map[string]any, extra []string) []configProblem {
+	var problems []configProblem
+	seen := make(map[configProblem]bool)
+	report := func(problem configProblem) {
+		if !seen[problem] {
+			seen[problem] = true
+			problems = append(problems, problem)
+		}
+	}
+
+	// a key is unknown when every struct rejects it, or a table holding it
+	rejected := make([]map[string]bool, len(schema.types))
+	for i, t := range schema.types {
+		rejected[i] = make(map[string]bool)
+
+		decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			Result:      reflect.New(t).Interface(),
+			TagName:     schema.tagName,
+			ErrorUnused: true,
+			DecodeHook:  mapstructure.StringToTimeDurationHookFunc(),
+		})
+		if err != nil {
+			report(configProblem{Path: path, Message: err.Error()})
+			continue
+		}
+
+		var decodeErr *mapstructure.Error
+		if err := decoder.Decode(settings); !errors.As(err, &decodeErr) {
+			if err != nil {
+				report(configProblem{Path: path, Message: err.Error()})
+			}
+			continue
+		}
+
+		for _, msg := range decodeErr.Errors {
+			match := decodeErrorPattern.FindStringSubmatch(msg)
+			if match == nil {
+				report(configProblem{Path: path, Message: msg})
+				continue
+			}
+
+			name, message := match[1], match[2]
+			if keys, ok := strings.CutPrefix(message, "has invalid keys: "); ok {
+				for _, key := range strings.Split(keys, ", ") {
+					rejected[i][joinSettingPath(name, key)] = true
+				}
+				continue
+			}
+			report(configProblem{Path: joinSettingPath(path, name), Message: message})
+		}
+	}
+
+	isUnknown := func(key string) bool {
+		if containsString(extra, key) {
+			return false
+		}
+		for _, keys := range rejected {
+			if !keys[key] && !rejectsParent(keys, key) {
+				return false
+			}
+		}
+		return true
+	}
+	var unknown []string
+	for _, keys := range rejected {
+		for key := range keys {
+			if isUnknown(key) && !containsString(unknown, key) {
+				unknown = append(unknown, key)
+			}
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		if parent := parentSetting(key); parent != "" && containsString(unknown, parent) {
+			continue
+		}
+
+		parent, name := "", key
+		if i := strings.LastIndex(key, "."); i >= 0 {
+			parent, name = key[:i], key[i+1:]
+		}
+
+		candidates := schema.keysAt(parent)
+		if parent == "" {
+			candidates = append(candidates, extra...)
+		}
+		report(configProblem{Path: joinSettingPath(path, key), Message: unknownKeyMessage(name, candidates)})
+	}
+
+	if len(problems) == 0 && schema.check != nil {
+		if err := schema.check(settings); err != nil {
+			message := err.Error()
+			if rest, ok := strings.CutPrefix(message, path[strings.LastIndex(path, ".")+1:]+": "); ok {
+				message = rest
+			}
+			report(configProblem{Path: path, Message: message})
+		}
+	}
+
+	return problems
+}
+
+// rejectsParent reports whether keys holds a table enclosing key.
+func rejectsParent(keys map[string]bool, key string) bool {
+	for parent := parentSetting(key); parent != ""; parent = parentSetting(parent) {
+		if keys[parent] {
+			return true
+		}
+	}
+	return false
+}
+
+// parentSetting returns the path of the table holding the setting at path,
+// ignoring list indexes, empty at the top level.
+func parentSetting(path string) string {
+	path = settingIndex.ReplaceAllString(path, "")
+	if i := strings.LastIndex(path, "."); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// settingIndex matches the index of a list element in a setting path, like
+// the [0] of gemini.safety_settings[0].category.
+var settingIndex = regexp.MustCompile(`\[\d+\]`)
+
+// keysAt returns the keys of the table at the dotted path in the schema.
+func (schema *configSchema) keysAt(path string) []string {
+	var keys []string
+
+	for _, t := range schema.types {
+		if path != "" {
+			for _, name := range strings.Split(settingIndex.ReplaceAllString(path, ""), ".") {
+				t = fieldType(t, schema.tagName, name)
+				if t == nil {
+					break
+				}
+			}
+		}
+		if t == nil {
+			continue
+		}
+
+		for i := 0; i < t.NumField(); i++ {
+			if name := tagName(t.Field(i), schema.tagName); name != "" {
+				keys = append(keys, name)
+			}
+		}
+	}
+
+	return keys
+}
+
+// fieldType returns the struct type of the field with the given tag name,
+// looking through pointers and lists, or nil.
+func fieldType(t reflect.Type, tag, name string) reflect.Type {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if tagName(field, tag) != name {
+			continue
+		}
+
+		ft := field.Type
+		for ft.Kind() == reflect.Pointer || ft.Kind() == reflect.Slice || ft.Kind() == reflect.Array {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct {
+			return ft
+		}
+		return nil
+	}
+
+	return nil
+}
+
+func tagName(field reflect.StructField, tag string) string {
+	name, _, _ := strings.Cut(field.Tag.Get(tag), ",")
+	if name == "-" || !field.IsExported() {
+		return ""
+	}
+	return name
+}
+
+// unknownKeyMessage describes an unknown key, suggesting the closest of the
+// valid ones.
+func unknownKeyMessage(key string, candidates []string) string {
+	if closest := closestKey(key, candidates); closest != "" {
+		return fmt.Sprintf("unknown key, did you mean %s?", closest)
+	}
+	return "unknown key"
+}
+
+// closestKey returns the candidate closest to key when it is close enough
+// for key to be a typo of it, or an empty string.
+func closestKey(key string, candidates []string) string {
+	best, bestDistance := "", len(key)/3+2
+	sort.Strings(candidates)
+	for _, candidate := range candidates {
+		if distance := editDistance(key, candidate); distance < bestDistance {
+			best, bestDistance = candidate, distance
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+func minInt(values ...int) int {
+	min := values[0]
+	for _, value := range values[1:] {
+		if value < min {
+			min = value
+		}
+	}
+	return min
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func joinSettingPath(prefix, name string) string {
+	switch {
+	case prefix == "":
+		return name
+	case name == "":
+		return prefix
+	}
+	return prefix + "." + name
+}
+
+// walkNumbers calls fn with the dotted path and the value of every number
+// of values, tables included.
+func walkNumbers(values map[string]any, prefix string, fn func(path string, value float64)) {
+	for key, value := range values {
+		path := joinSettingPath(prefix, key)
+		switch v := reflect.ValueOf(value); v.Kind() {
+		case reflect.Map:
+			if table, ok := value.(map[string]any); ok {
+				walkNumbers(table, path, fn)
+			}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			fn(path, float64(v.Int()))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			fn(path, float64(v.Uint()))
+		case reflect.Float32, reflect.Float64:
+			fn(path, v.Float())
+		}
+	}
+}
+
+// originOf returns where the setting at path, or the closest setting
+// enclosing it or enclosed in it, comes from.
+func (file *configFile) originOf(path string) string {
+	path = settingIndex.ReplaceAllString(path, "")
+	for candidate := path; candidate != ""; {
+		if origin, ok := file.origins[candidate]; ok {
+			return origin
+		}
+		i := strings.LastIndex(candidate, ".")
+		if i < 0 {
+			break
+		}
+		candidate = candidate[:i]
+	}
+
+	var enclosed []string
+	for setting := range file.origins {
+		if strings.HasPrefix(setting, path+".") {
+			enclosed = append(enclosed, setting)
+		}
+	}
+	if len(enclosed) == 0 {
+		return ""
+	}
+	sort.Strings(enclosed)
+	return file.origins[enclosed[0]]
+}
+
+// settingLine returns the line of the setting at path in the file origin,
+// 0 when origin isn't a file. lines caches the lines of the files read.
+func settingLine(lines map[string]map[string]int, origin, path string) int {
+	if origin == "" {
+		return 0
+	}
+
+	fileLines, ok := lines[origin]
+	if !ok {
+		if info, err := os.Stat(origin); err == nil && info.Mode().IsRegular() {
+			if contents, err := os.ReadFile(origin); err == nil {
+				fileLines = settingLines(string(contents))
+			}
+		}
+		lines[origin] = fileLines
+	}
+
+	path = settingIndex.ReplaceAllString(path, "")
+	for {
+		if line, ok := fileLines[path]; ok {
+			return line
+		}
+		i := strings.LastIndex(path, ".")
+		if i < 0 {
+			return 0
+		}
+		path = path[:i]
+	}
+}
+
+// settingLines maps the dotted path of every key and table header of a toml
+// document to the line it is first set at. Values spanning several lines are
+// skipped, but for multi-line strings, which could hold anything.
+func settingLines(contents string) map[string]int {
+	lines := make(map[string]int)
+	prefix := ""
+	closing := ""
+
+	for i, line := range strings.Split(contents, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if closing != "" {
+			if strings.Contains(trimmed, closing) {
+				closing = ""
+			}
+			continue
+		}
+		if trimmed == "" || trimmed[0] == '#' {
+			continue
+		}
+
+		if trimmed[0] == '[' {
+			header := strings.TrimLeft(trimmed, "[")
+			if end := strings.Index(header, "]"); end >= 0 {
+				header = header[:end]
+			}
+			path := strings.Join(splitTOMLKey(header), ".")
+			if _, ok := lines[path]; !ok {
+				lines[path] = i + 1
+			}
+			prefix = path + "."
+			continue
+		}
+
+		key, value, ok := strings.Cut(trimmed, "=")
+		if !ok {
+			continue
+		}
+		path := prefix + strings.Join(splitTOMLKey(key), ".")
+		if _, ok := lines[path]; !ok {
+			lines[path] = i + 1
+		}
+
+		for _, quotes := range []string{`"""`, `'''`} {
+			if strings.Count(value, quotes)%2 == 1 {
+				closing = quotes
+			}
+		}
+	}
+
+	return lines
+}
+
+// splitTOMLKey splits a dotted toml key, unquoting its parts.
+func splitTOMLKey(key string) []string {
+	var (
+		parts []string
+		part  strings.Builder
+		quote rune
+	)
+	for _, r := range key {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			part.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '.':
+			parts = append(parts, strings.TrimSpace(part.String()))
+			part.Reset()
+		default:
+			part.WriteRune(r)
+		}
+	}
+	return append(parts, strings.TrimSpace(part.String()))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	assert.NoError(t, os.WriteFile(path, []byte(`provder = "openai"
+
+[openai]
+model = "gpt-4"
+max_token = 100
+temperature = 3.5
+n = "two"
+
+[opanai]
+model = "gpt-4"
+
+[groq]
+base_url = "https://api.groq.com/openai/v1"
+
+[gemini]
+model = "gemini-pro"
+generation_config = { top_kk = 3 }
+
+[[gemini.safety_settings]]
+categry = "HARM_CATEGORY_HARASSMENT"
+
+[context]
+strategy = "messages"
+
+[http]
+timout = "10s"
+
+[profiles.fast]
+provider = "openai"
+temprature = 0.2
+aliases = { small = 1 }
+`), 0600))
+	t.Setenv("SIRA_OLLAMA_MODEL", "llama2")
+	t.Setenv("SIRA_OLLAMA_KEEPALIVE", "5m")
+
+	config, err := loadConfigFiles([]string{path})
+	assert.NoError(t, err)
+
+	err = config.validate()
+	assert.EqualError(t, err, strings.Join([]string{
+		"invalid config:",
+		"  " + path + ":1: provder: unknown key, did you mean provider?",
+		"  " + path + ":5: openai.max_token: unknown key, did you mean max_tokens?",
+		"  " + path + ":6: openai.temperature: must be between 0 and 2, got 3.5",
+		"  " + path + ":7: openai.n: expected type 'int', got unconvertible type 'string', value: 'two'",
+		"  " + path + ":9: opanai: unknown section, did you mean openai?",
+		"  " + path + ":12: groq: unknown section, set its type to one of [anthropic gemini mistral ollama openai] to use it as a provider",
+		"  " + path + ":17: gemini.generation_config.top_kk: unknown key, did you mean top_k?",
+		"  " + path + ":20: gemini.safety_settings[0].categry: unknown key, did you mean category?",
+		"  " + path + ":22: context: max_messages must be positive with the \"messages\" strategy",
+		"  " + path + ":26: http.timout: unknown key, did you mean timeout?",
+		"  " + path + ":30: profiles.fast.temprature: unknown key, did you mean temperature?",
+		"  " + path + ":31: profiles.fast.aliases.small: must name a model, got int64",
+		"  env SIRA_OLLAMA_KEEPALIVE: ollama.keepalive: unknown key, did you mean keep_alive?",
+	}, "\n"))
+
+	valid, err := parseConfig(`
+provider = "groq"
+default_profile = "local"
+
+[groq]
+type = "openai"
+base_url = "https://api.groq.com/openai/v1"
+model = "llama3-8b-8192"
+temperature = 0.2
+headers = { X-Custom = "value" }
+
+[ollama]
+model = "llama2"
+options = { temperature = 0.1 }
+
+[context]
+summarize = true
+
+[http]
+timeout = "5m"
+
+[profiles.local]
+provider = "ollama"
+options = { num_ctx = 4096 }
+aliases = { big = "llama3:70b" }
+`)
+	assert.NoError(t, err)
+	assert.NoError(t, valid.validate())
+}
+
+func TestSettingLines(t *testing.T) {
+	lines := settingLines(`apikey = "sk-..."
+prompt = """
+model = "not a key"
+"""
+
+[openai] # comment
+"max tokens" = 100
+headers.X-Custom = "value"
+
+[[gemini.safety_settings]]
+category = "HARM_CATEGORY_HARASSMENT"
+`)
+
+	assert.Equal(t, map[string]int{
+		"apikey":                          1,
+		"prompt":                          2,
+		"openai":                          6,
+		"openai.max tokens":               7,
+		"openai.headers.X-Custom":         8,
+		"gemini.safety_settings":          10,
+		"gemini.safety_settings.category": 11,
+	}, lines)
+}
+
+func TestMistralModelRequired(t *testing.T) {
+	_, err := decodeMistralRequest(map[string]any{"temperature": 0.2})
+	assert.EqualError(t, err, "mistral: model is required")
+}
+
+func TestCLIChatInvalidConfig(t *testing.T) {
+	config, received := newOllamaConfig(t)
+	contents, err := os.ReadFile(config)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(config, append(contents, "kep_alive = '5m'\n"...), 0600))
+
+	filename := filepath.Join(t.TempDir(), "chat.md")
+	assert.NoError(t, os.WriteFile(filename, []byte("# user\nhi\n"), 0644))
+
+	code, _, stderr := runSira(t, "", "--config", config, filename)
+	assert.Equal(t, exitError, code)
+	assert.Equal(t, "sira: invalid config:\n  "+config+":11: ollama.kep_alive: unknown key, did you mean keep_alive?\n", stderr)
+
+	code, _, stderr = runSira(t, "", "--config", config, "config", "validate")
+	assert.Equal(t, exitError, code)
+	assert.Contains(t, stderr, "ollama.kep_alive")
+
+	assert.NoError(t, os.WriteFile(config, contents, 0600))
+	assert.NoError(t, os.WriteFile(filename, []byte("+++\ntemprature = 0.1\n+++\n# user\nhi\n"), 0644))
+
+	code, _, stderr = runSira(t, "", "--config", config, filename)
+	assert.Equal(t, exitError, code)
+	assert.Equal(t, "sira: invalid config:\n  ollama.temprature: unknown key, did you mean temperature?\n", stderr)
+
+	code, _, stderr = runSira(t, "", "--config", config, "config", "validate")
+	assert.Equal(t, exitOK, code, stderr)
+	assert.Empty(t, *received)
+}